@@ -1,13 +1,28 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"log"
+	"io"
+	"log/slog"
 	"net/http"
+	"net/mail"
 	"os"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	jwt "github.com/golang-jwt/jwt/v4"
 	"golang.org/x/oauth2"
@@ -19,6 +34,33 @@ func WriteJson(w http.ResponseWriter, status int, v any) error {
 	return json.NewEncoder(w).Encode(v)
 }
 
+// decodeJSON reads the request body into v, answering with a 400 for a body
+// over MaxBodyBytes, one that isn't a single json value, or one with fields
+// v doesn't have (most likely a typo the client would want to hear about).
+// The HttpError wraps the decoder's error, so e.g. ErrAmountOutOfRange can
+// still be told apart.
+func (s *ApiServer) decodeJSON(w http.ResponseWriter, r *http.Request, v any) error {
+	r.Body = http.MaxBytesReader(w, r.Body, s.config.MaxBodyBytes)
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	err := decoder.Decode(v)
+	if err == nil && decoder.Decode(&struct{}{}) != io.EOF {
+		err = errors.New("body must hold a single json value")
+	}
+	var tooBig *http.MaxBytesError
+	switch {
+	case err == nil:
+		return nil
+	case errors.As(err, &tooBig):
+		return &HttpError{Status: http.StatusBadRequest, Code: CodeInvalidRequest,
+			Message: fmt.Sprintf("request body is over the %d byte limit", tooBig.Limit), err: err}
+	case errors.Is(err, io.EOF):
+		return &HttpError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "request body is empty", err: err}
+	}
+	return &HttpError{Status: http.StatusBadRequest, Code: CodeInvalidRequest, Message: "invalid request body: " + err.Error(), err: err}
+}
+
 func WriteHtml(w http.ResponseWriter, status int, v string) {
 	w.WriteHeader(status)
 	fmt.Fprint(w, v)
@@ -26,250 +68,2110 @@ func WriteHtml(w http.ResponseWriter, status int, v string) {
 
 type apiFunc func(http.ResponseWriter, *http.Request) error
 
+// ApiError is the body of every json error. Code is one of the ErrorCode
+// constants for clients to branch on, Message is for showing to people.
+// Error repeats Message for clients from before there were codes.
 type ApiError struct {
-	Error string
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	Error   string
+}
+
+func newApiError(code ErrorCode, message string) *ApiError {
+	return &ApiError{Code: code, Message: message, Error: message}
+}
+
+// HttpError is a handler error that isn't the server's fault. Its status is
+// what makeHttpHandleFunc answers with and its code and message go to the
+// client.
+type HttpError struct {
+	Status  int
+	Code    ErrorCode
+	Message string
+	// err is what caused it, if anything, for errors.Is
+	err error
+}
+
+func (e *HttpError) Error() string {
+	return e.Message
+}
+
+func (e *HttpError) Unwrap() error {
+	return e.err
+}
+
+// httpErrorf is an HttpError with the generic code for its status
+func httpErrorf(status int, format string, args ...any) error {
+	return codedErrorf(status, codeForStatus(status), format, args...)
+}
+
+func codedErrorf(status int, code ErrorCode, format string, args ...any) error {
+	return &HttpError{Status: status, Code: code, Message: fmt.Sprintf(format, args...)}
+}
+
+// ValidationError is a request with fields that don't pass muster, keyed by
+// their json name. makeHttpHandleFunc answers it with 422 and the details.
+type ValidationError struct {
+	Fields map[string]string
+}
+
+func (e *ValidationError) Error() string {
+	problems := []string{}
+	for field, problem := range e.Fields {
+		problems = append(problems, field+" "+problem)
+	}
+	sort.Strings(problems)
+	return "invalid request: " + strings.Join(problems, ", ")
 }
 
-func withJwtAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+func (s *ApiServer) withJwtAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		fmt.Println("Calling JWTAuth middleware")
-		tokenStr := r.Header.Get("x-jwt-token")
-		token, err := validateJwt(tokenStr)
+		s.logger.DebugContext(r.Context(), "checking jwt", "path", r.URL.Path)
+		claims, account, err := s.authenticate(r)
 		if err != nil {
-			WriteJson(w, http.StatusForbidden, &ApiError{Error: "invalid token"})
+			s.logAuthDecision(r, "anonymous", false, err.Error())
+			if !isTokenRejection(err) {
+				WriteJson(w, http.StatusInternalServerError, newApiError(CodeInternal, "could not check token"))
+				return
+			}
+			// no token at all is a 401, a token that's no good a 403
+			if errors.Is(err, ErrNoToken) {
+				w.Header().Set("WWW-Authenticate", "Bearer")
+				WriteJson(w, http.StatusUnauthorized, newApiError(tokenErrorCode(err), err.Error()))
+				return
+			}
+			WriteJson(w, http.StatusForbidden, newApiError(tokenErrorCode(err), err.Error()))
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
-			fmt.Printf("Found AccountNumber: %v\n", claims["accountNumber"])
+		principal := fmt.Sprintf("account:%v", claims["accountNumber"])
+
+		// routes about one account are only for that account's owner
+		if idStr := r.PathValue("id"); idStr != "" {
+			if id, err := strconv.Atoi(idStr); err != nil || id != account.Id {
+				s.logAuthDecision(r, principal, false, "not the account owner")
+				WriteJson(w, http.StatusForbidden, newApiError(CodeNotYourAccount, "not your account"))
+				return
+			}
+		}
+
+		s.logAuthDecision(r, principal, true, "valid token")
+		handlerFunc(w, r.WithContext(context.WithValue(r.Context(), authedAccountKey{}, account)))
+	}
+}
+
+type authedAccountKey struct{}
+
+// authedAccount is the account whose token got the request through withJwtAuth
+func authedAccount(r *http.Request) *Account {
+	account, _ := r.Context().Value(authedAccountKey{}).(*Account)
+	return account
+}
+
+var (
+	ErrNoToken      = errors.New("no token")
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenRevoked = errors.New("token revoked")
+)
+
+// isTokenRejection tells the token's own faults apart from failing to check it
+func isTokenRejection(err error) bool {
+	return errors.Is(err, ErrNoToken) || errors.Is(err, ErrInvalidToken) ||
+		errors.Is(err, ErrTokenExpired) || errors.Is(err, ErrTokenRevoked)
+}
+
+// requestToken is the token the request was sent with: from an
+// Authorization: Bearer header, or failing that the older x-jwt-token header
+func requestToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if ok && strings.EqualFold(scheme, "Bearer") {
+		if token = strings.TrimSpace(token); token != "" {
+			return token
+		}
+	}
+	return r.Header.Get("x-jwt-token")
+}
+
+// authenticate runs every check a request's token has to pass and hands back
+// its claims and the account it was issued for. It's the one place token
+// validity is decided.
+func (s *ApiServer) authenticate(r *http.Request) (jwt.MapClaims, *Account, error) {
+	tokenString := requestToken(r)
+	if tokenString == "" {
+		return nil, nil, ErrNoToken
+	}
+	token, err := s.validateJwt(tokenString)
+	if errors.Is(err, ErrTokenExpired) {
+		return nil, nil, err
+	}
+	if err != nil {
+		return nil, nil, ErrInvalidToken
+	}
+
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !token.Valid {
+		return nil, nil, fmt.Errorf("%w: unreadable claims", ErrInvalidToken)
+	}
+
+	// json numbers come out of the claims as float64
+	number, ok := claims["accountNumber"].(float64)
+	if !ok {
+		return nil, nil, fmt.Errorf("%w: no account number", ErrInvalidToken)
+	}
+	account, err := s.store.GetAccountByNumber(r.Context(), int64(number))
+	if err != nil {
+		return nil, nil, err
+	}
+	if account == nil {
+		return nil, nil, fmt.Errorf("%w: account is gone", ErrInvalidToken)
+	}
+
+	// revoking bumps the account's epoch, which every older token still carries.
+	// Tokens from before epochs existed count as epoch 0.
+	epoch, _ := claims["epoch"].(float64)
+	if int64(epoch) != account.TokenEpoch {
+		return nil, nil, ErrTokenRevoked
+	}
+	return claims, account, nil
+}
+
+// logAuthDecision records who was let in (or kept out of) what, and why.
+// Denials are warnings so they stand out. Never hand it the raw token.
+func (s *ApiServer) logAuthDecision(r *http.Request, principal string, allowed bool, reason string) {
+	attrs := []any{
+		"principal", principal,
+		"resource", r.Method + " " + r.URL.Path,
+		"reason", reason,
+	}
+	if allowed {
+		s.logger.InfoContext(r.Context(), "authorization granted", append(attrs, "decision", "allow")...)
+		return
+	}
+	s.logger.WarnContext(r.Context(), "authorization denied", append(attrs, "decision", "deny")...)
+}
+
+// withAdminAuth only lets through requests carrying the ADMIN_TOKEN in the
+// x-admin-token header. Config requires one, but should it ever be empty
+// admin routes are closed rather than open.
+func (s *ApiServer) withAdminAuth(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !s.isAdmin(r) {
+			reason := "wrong admin token"
+			if s.config.AdminToken == "" {
+				reason = "admin access disabled"
+			}
+			s.logAuthDecision(r, "anonymous", false, reason)
+			WriteJson(w, http.StatusForbidden, newApiError(CodeAdminRequired, "admin access required"))
+			return
 		}
+		s.logAuthDecision(r, "admin", true, "valid admin token")
 		handlerFunc(w, r)
 	}
 }
 
-func validateJwt(tokenStr string) (*jwt.Token, error) {
-	secret := os.Getenv("JWT_SECRET")
-	return jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+// isAdmin says whether the request carries the ADMIN_TOKEN, for routes that
+// aren't admin only but have admin only options
+func (s *ApiServer) isAdmin(r *http.Request) bool {
+	given := r.Header.Get("x-admin-token")
+	return s.config.AdminToken != "" && subtle.ConstantTimeCompare([]byte(given), []byte(s.config.AdminToken)) == 1
+}
+
+var (
+	ErrNoJwtSecret  = errors.New("no JWT_SECRET configured")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// validateJwt accepts a token signed with any of the configured secrets, so
+// tokens signed before a rotation keep working. Only a bad signature moves on
+// to the next secret; any other problem means the token is bad whatever the key.
+func (s *ApiServer) validateJwt(tokenStr string) (*jwt.Token, error) {
+	err := ErrNoJwtSecret
+	var token *jwt.Token
+	for _, secret := range s.config.JwtSecrets {
+		token, err = jwt.Parse(tokenStr, func(token *jwt.Token) (interface{}, error) {
+			if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+				return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+			}
+
+			return []byte(secret), nil
+		})
+		if err == nil {
+			break
+		}
+		if errors.Is(err, jwt.ErrTokenExpired) {
+			return nil, ErrTokenExpired
 		}
+		if !errors.Is(err, jwt.ErrTokenSignatureInvalid) {
+			return nil, err
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
 
-		return []byte(secret), nil
-	})
+	// the parser only checks exp when it's there, but every token we issue
+	// has one, so one without it wasn't made by us
+	claims, ok := token.Claims.(jwt.MapClaims)
+	if !ok || !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, fmt.Errorf("token has no expiry")
+	}
+	return token, nil
 }
 
-func createJwt(account *Account) (string, error) {
-	secret := os.Getenv("JWT_SECRET")
+// createJwt signs with the active (first) secret
+func (s *ApiServer) createJwt(account *Account) (string, error) {
+	if len(s.config.JwtSecrets) == 0 {
+		return "", ErrNoJwtSecret
+	}
+	now := time.Now()
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"expiresAt":     15_000,
+		"exp":           now.Add(s.config.JwtTtl).Unix(),
+		"iat":           now.Unix(),
 		"accountNumber": account.Number,
+		"epoch":         account.TokenEpoch,
 	})
 
-	return token.SignedString([]byte(secret))
+	return token.SignedString([]byte(s.config.JwtSecrets[0]))
+}
+
+// makeHttpHandleFunc answers a handler's error as json: an HttpError with its
+// own status and message, anything else as a 500. Outside of dev the 500's
+// message is generic, since it can carry internals; the real one is logged.
+func (s *ApiServer) makeHttpHandleFunc(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := f(w, r)
+		if err == nil {
+			return
+		}
+
+		var httpErr *HttpError
+		if errors.As(err, &httpErr) {
+			WriteJson(w, httpErr.Status, newApiError(httpErr.Code, httpErr.Message))
+			return
+		}
+		var validationErr *ValidationError
+		if errors.As(err, &validationErr) {
+			WriteJson(w, http.StatusUnprocessableEntity, struct {
+				*ApiError
+				Fields map[string]string `json:"fields"`
+			}{newApiError(CodeValidationFailed, "invalid request"), validationErr.Fields})
+			return
+		}
+
+		s.logger.ErrorContext(r.Context(), "request failed", "err", err)
+		message := "internal server error"
+		if s.config.Environment != EnvProd {
+			message = err.Error()
+		}
+		WriteJson(w, http.StatusInternalServerError, newApiError(CodeInternal, message))
+	}
+}
+
+// makeViewHandleFunc is makeHttpHandleFunc for the pages a browser loads,
+// answering errors with the html error page instead of json
+func (s *ApiServer) makeViewHandleFunc(f apiFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		err := f(w, r)
+		if err == nil {
+			return
+		}
+
+		status := http.StatusInternalServerError
+		var httpErr *HttpError
+		if errors.As(err, &httpErr) {
+			status = httpErr.Status
+		}
+		s.writeErrorPage(w, r, status, err)
+	}
+}
+
+// allowMethods answers 405 with an Allow header for any method not listed,
+// so handlers only ever see the methods they were written for.
+func allowMethods(handlerFunc http.HandlerFunc, methods ...string) http.HandlerFunc {
+	allow := strings.Join(methods, ", ")
+	return func(w http.ResponseWriter, r *http.Request) {
+		for _, method := range methods {
+			if r.Method == method {
+				handlerFunc(w, r)
+				return
+			}
+		}
+		w.Header().Set("Allow", allow)
+		WriteJson(w, http.StatusMethodNotAllowed, newApiError(CodeMethodNotAllowed, fmt.Sprintf("method not allowed: %s", r.Method)))
+	}
 }
 
-func makeHttpHandleFunc(f apiFunc) http.HandlerFunc {
+// withSemaphore lets through only as many requests at once as sem has room
+// for. Anything beyond that is turned away with a 503 rather than queued, so
+// a pile up can't hold connections open.
+func withSemaphore(sem chan struct{}, handlerFunc http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		if err := f(w, r); err != nil {
-			WriteHtml(w, http.StatusInternalServerError, fmt.Sprintf("<h1>Error</h1><p>%v</p>", err))
+		select {
+		case sem <- struct{}{}:
+			defer func() { <-sem }()
+			handlerFunc(w, r)
+		default:
+			w.Header().Set("Retry-After", "1")
+			WriteJson(w, http.StatusServiceUnavailable, newApiError(CodeBusy, "too many transfers in progress, try again shortly"))
 		}
 	}
 }
 
 type ApiServer struct {
 	listenAddr string
+	config     *Config
 	store      Storage
 	auth       *oauth2.Config
+	avatars    *avatarFetcher
+	// cleaner clears out expired state in the background
+	cleaner   *cleaner
+	notifier  Notifier
+	webhooks  *webhookSender
+	templates *template.Template
+	views     *template.Template
+	logger    *slog.Logger
+	// transferSlots is a semaphore bounding in flight transfers
+	transferSlots chan struct{}
+	// authLimiter rate limits logins and account creation per ip
+	authLimiter *rateLimiter
+	metrics     *metrics
 }
 
-func NewApiService(listenAddr string, store Storage, auth *oauth2.Config) *ApiServer {
-	return &ApiServer{
-		listenAddr: listenAddr,
+// NewApiService sets up the server, failing if the templates can't be parsed
+func NewApiService(config *Config, store Storage, auth *oauth2.Config) (*ApiServer, error) {
+	logger := slog.Default()
+	s := &ApiServer{
+		listenAddr: config.ListenAddr,
+		config:     config,
 		store:      store,
 		auth:       auth,
+		avatars:    newAvatarFetcher(logger),
+		notifier:   newNotifier(config, logger),
+		webhooks:   newWebhookSender(config.WebhookUrls, config.WebhookSecret, logger),
+		logger:     logger,
+
+		transferSlots: make(chan struct{}, config.MaxConcurrentTransfers),
+		authLimiter:   newRateLimiter(config.RateLimit, config.RateLimitBurst),
+		metrics:       newMetrics(),
+	}
+	s.cleaner = newCleaner(store, s.avatars, config.CleanupInterval, config.CleanupBatchSize, s.logger)
+	templates, err := parseTemplates(s.templateFuncs(), templDir)
+	if err != nil {
+		return nil, err
 	}
+	s.templates = templates
+	if s.views, err = parseTemplates(s.templateFuncs(), viewDir); err != nil {
+		return nil, err
+	}
+	if err := s.checkTemplates(); err != nil {
+		return nil, err
+	}
+	return s, nil
 }
 
-func (s *ApiServer) Run() {
-	router := http.NewServeMux()
+// Run serves until the listener fails or the process gets SIGINT/SIGTERM,
+// in which case it stops accepting connections and waits up to
+// ShutdownTimeout for requests in flight, then queued webhooks, to finish.
+// The store is closed on the way out. With a certificate configured it
+// serves https, which net/http upgrades to http/2 for clients that offer it.
+func (s *ApiServer) Run() error {
+	go s.cleaner.run()
+	defer s.cleaner.Close()
+	defer s.store.Close()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go s.webhooks.run()
+	go s.authLimiter.run()
+	defer s.authLimiter.Close()
 
-	router.Handle("/", http.FileServer(http.Dir("./static")))
+	server := s.httpServer()
+	listenErr := make(chan error, 1)
+	go func() {
+		if s.config.TlsCertFile != "" {
+			s.logger.Info("server listening", "addr", s.listenAddr, "tls", true,
+				"tls_min_version", tls.VersionName(server.TLSConfig.MinVersion),
+				"tls_cipher_suites", len(server.TLSConfig.CipherSuites))
+			listenErr <- server.ListenAndServeTLS(s.config.TlsCertFile, s.config.TlsKeyFile)
+			return
+		}
+		s.logger.Info("server listening", "addr", s.listenAddr, "tls", false)
+		listenErr <- server.ListenAndServe()
+	}()
 
-	router.HandleFunc("/login", func(w http.ResponseWriter, r *http.Request) {
-		http.Redirect(w, r, s.auth.AuthCodeURL("randomstate"), http.StatusTemporaryRedirect)
-	})
-	router.HandleFunc("/auth/callback", s.handleAuthCallback)
+	select {
+	case err := <-listenErr:
+		return err
+	case <-ctx.Done():
+	}
 
-	router.HandleFunc("/view/{viewName}", makeHttpHandleFunc(s.handleView))
+	s.logger.Info("shutting down, draining requests", "timeout", s.config.ShutdownTimeout)
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), s.config.ShutdownTimeout)
+	defer cancel()
+	err := server.Shutdown(shutdownCtx)
+	// after the requests, so any webhooks they queued still go out
+	s.webhooks.Close(shutdownCtx)
+	return err
+}
 
-	router.HandleFunc("/account", makeHttpHandleFunc(s.handleAccounts))
-	router.HandleFunc("/account/{id}", withJwtAuth(makeHttpHandleFunc(s.handleOneAccount)))
+// httpServer applies the configured timeouts. A zero timeout means none,
+// except ReadHeaderTimeout which config always sets.
+func (s *ApiServer) httpServer() *http.Server {
+	return &http.Server{
+		Addr:              s.listenAddr,
+		Handler:           s.handler(),
+		ReadHeaderTimeout: s.config.ReadHeaderTimeout,
+		ReadTimeout:       s.config.ReadTimeout,
+		WriteTimeout:      s.config.WriteTimeout,
+		IdleTimeout:       s.config.IdleTimeout,
+		TLSConfig:         s.tlsConfig(),
+	}
+}
 
-	router.HandleFunc("/transfer", makeHttpHandleFunc(s.handleTransfer))
+// tlsCipherSuites are the tls 1.2 suites we accept: forward secret key
+// exchange and aead ciphers only. tls 1.3's suites aren't configurable and
+// are all fine.
+var tlsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305_SHA256,
+}
 
-	log.Printf("Server running on port: %v\n", s.listenAddr)
+// tlsConfig is the tls policy for serving https: no older protocol than
+// TlsMinVersion, and only tlsCipherSuites.
+func (s *ApiServer) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:   s.config.TlsMinVersion,
+		CipherSuites: tlsCipherSuites,
+	}
+}
 
-	http.ListenAndServe(s.listenAddr, router)
+// handler is the full http handler: the routes plus the middleware that
+// applies to every one of them.
+func (s *ApiServer) handler() http.Handler {
+	router := s.routes()
+	return s.withRequestTags(router, s.withCompression(s.withCors(s.withRequestTimeout(router))))
 }
 
-/*
-/avatars/user_id/user_avatar.png
-https://cdn.discordapp.com/avatars/485103041738047489/13a45106234fa19fd7b22795df2b6833.png
-*/
+// corsAllowedHeaders are the request headers cross origin callers may send:
+// the token headers and the ones htmx adds to its requests
+var corsAllowedHeaders = strings.Join([]string{
+	"Content-Type", "X-Request-Id", "Authorization", "x-jwt-token", "X-Sandbox",
+	"Hx-Request", "Hx-Current-Url", "Hx-Target", "Hx-Trigger", "Hx-Trigger-Name",
+}, ", ")
 
-func (s *ApiServer) handleAuthCallback(w http.ResponseWriter, r *http.Request) {
-	if r.FormValue("state") != "randomstate" {
-		w.WriteHeader(http.StatusBadRequest)
-		w.Write([]byte("State does not match."))
-		return
+// withCors lets the origins in CorsOrigins call the api from the browser and
+// answers their OPTIONS preflights itself. Preflights from anywhere else get
+// a 403; their other requests go through without cors headers, so the
+// browser won't let the page read the response.
+func (s *ApiServer) withCors(next http.Handler) http.Handler {
+	allowed := map[string]bool{}
+	for _, origin := range s.config.CorsOrigins {
+		allowed[origin] = true
 	}
 
-	token, err := s.auth.Exchange(r.Context(), r.FormValue("code"))
-	if err != nil {
-		quickErr(w, err)
-		return
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		if origin == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+
+		if !allowed[origin] {
+			if preflight {
+				WriteJson(w, http.StatusForbidden, newApiError(CodeOriginNotAllowed, "origin not allowed"))
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		w.Header().Set("Access-Control-Expose-Headers", "X-Request-Id")
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", "GET, HEAD, POST, PUT, PATCH, DELETE")
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowedHeaders)
+			w.Header().Set("Access-Control-Max-Age", "600")
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+type untimedContextKey struct{}
+
+// withRequestTimeout gives each request's context RequestTimeout to live, so
+// a query stuck on a slow database fails instead of holding the request (and
+// a pool connection) forever.
+func (s *ApiServer) withRequestTimeout(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), s.config.RequestTimeout)
+		defer cancel()
+		ctx = context.WithValue(ctx, untimedContextKey{}, r.Context())
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// untimedContext is r's context from before withRequestTimeout, for the
+// streams that are expected to run long. It still ends when the client goes
+// away, but doesn't carry values added by the handlers inside.
+func untimedContext(r *http.Request) context.Context {
+	if ctx, ok := r.Context().Value(untimedContextKey{}).(context.Context); ok {
+		return ctx
 	}
+	return r.Context()
+}
 
-	res, err := s.auth.Client(r.Context(), token).Get("https://discord.com/api/users/@me")
-	if err != nil || res.StatusCode != 200 {
-		w.WriteHeader(http.StatusInternalServerError)
-		if err != nil {
-			w.Write([]byte(err.Error()))
-		} else {
-			w.Write([]byte(res.Status))
+// maxRequestIdLength stops a client stuffing huge ids into our logs
+const maxRequestIdLength = 128
+
+// withRequestTags puts the request id and matched route on the context so the
+// store can tag its queries with them, and the logger its lines. The id comes
+// from the X-Request-Id header; when that's missing it's either made up or
+// the request is refused, depending on the RequestIdMode. The id used is
+// echoed back either way. Every request is logged and counted for /metrics
+// once it's done. router is only asked which route matched; next serves the
+// request.
+func (s *ApiServer) withRequestTags(router *http.ServeMux, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		_, route := router.Handler(r)
+		requestId := r.Header.Get("X-Request-Id")
+		if requestId == "" || len(requestId) > maxRequestIdLength {
+			if s.config.RequestIdMode == RequestIdStrict {
+				s.logger.Warn("rejected request without a valid request id",
+					"remote_addr", r.RemoteAddr,
+					"method", r.Method,
+					"path", r.URL.Path,
+					"user_agent", r.UserAgent(),
+				)
+				WriteJson(w, http.StatusBadRequest, newApiError(CodeInvalidRequestId, "missing or invalid X-Request-Id header"))
+				s.metrics.observe(r.Method, route, http.StatusBadRequest, time.Since(start))
+				return
+			}
+			requestId = newRequestId()
 		}
-		return
+		w.Header().Set("X-Request-Id", requestId)
+
+		ctx := withQueryTags(r.Context(), queryTags{
+			RequestId:     requestId,
+			Route:         route,
+			CorrelationId: s.sessionCorrelationId(r),
+		})
+		rec := &statusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+		s.metrics.observe(r.Method, route, rec.Status(), time.Since(start))
+
+		level := slog.LevelInfo
+		if rec.Status() >= 500 {
+			level = slog.LevelError
+		}
+		s.logger.Log(ctx, level, "request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"route", route,
+			"status", rec.Status(),
+			"bytes", rec.bytes,
+			"duration", time.Since(start),
+		)
+	})
+}
+
+// statusRecorder remembers the status and size of a response for the
+// request log
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
 	}
-	defer res.Body.Close()
+	rec.ResponseWriter.WriteHeader(status)
+}
 
-	user := &DiscordUser{}
-	if json.NewDecoder(res.Body).Decode(&user); err != nil {
-		quickErr(w, err)
-		return
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
 	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.bytes += n
+	return n, err
+}
 
-	exists, err := s.store.DiscordUserExists(r.Context(), user.Id)
-	if err != nil {
-		quickErr(w, err)
+// Flush passes through so streamed responses still stream
+func (rec *statusRecorder) Flush() {
+	if flusher, ok := rec.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
 	}
+}
 
-	if !exists {
-		s.store.CreateDiscordUser(r.Context(), user)
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+func (rec *statusRecorder) Status() int {
+	if rec.status == 0 {
+		return http.StatusOK
 	}
+	return rec.status
 }
 
-func quickErr(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(err.Error()))
+func newRequestId() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
 }
 
-func (s *ApiServer) handleView(w http.ResponseWriter, r *http.Request) error {
-	var contentStr string
-	viewFileName := "./view/" + r.PathValue("viewName") + ".gohtml"
-	mainContent, err := os.ReadFile(viewFileName)
-	if os.IsNotExist(err) {
-		contentStr = "<p>👀What you're looking for cannot be found.</p>"
+func (s *ApiServer) routes() *http.ServeMux {
+	router := http.NewServeMux()
+
+	// anything not matched below, so a mistyped api path gets json rather
+	// than falling through to a page or a file. Every route restricts its
+	// methods with allowMethods, so the wrong method is always a json 405.
+	router.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		WriteJson(w, http.StatusNotFound, newApiError(CodeNotFound, fmt.Sprintf("no route for %s", r.URL.Path)))
+	})
+
+	router.HandleFunc("/healthz", allowMethods(s.makeHttpHandleFunc(s.handleHealthz), http.MethodGet, http.MethodHead))
+	router.HandleFunc("/readyz", allowMethods(s.makeHttpHandleFunc(s.handleReadyz), http.MethodGet, http.MethodHead))
+	router.HandleFunc("/metrics", allowMethods(s.makeHttpHandleFunc(s.handleMetrics), http.MethodGet))
+
+	router.HandleFunc("/{$}", allowMethods(s.makeViewHandleFunc(s.handleHome), http.MethodGet, http.MethodHead))
+	if s.config.StaticEnabled {
+		static := http.StripPrefix("/static", noDotfiles(http.FileServer(http.Dir("./static"))))
+		router.HandleFunc("/static/", allowMethods(static.ServeHTTP, http.MethodGet, http.MethodHead))
 	} else {
-		contentStr = string(mainContent)
+		router.HandleFunc("/static/", s.disabled("static file serving"))
 	}
 
-	// if this is not an htmx request, we need to provide the rest of the layout
-	if r.Header.Get("Hx-Request") == "" {
-		return handleWholeView(w, mainContent)
-	}
+	router.HandleFunc("/login", allowMethods(withRateLimit(s.authLimiter, s.makeViewHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+		state, err := s.issueOAuthState(w, r)
+		if err != nil {
+			return err
+		}
+		http.Redirect(w, r, s.auth.AuthCodeURL(state), http.StatusTemporaryRedirect)
+		return nil
+	})), http.MethodGet))
+	router.HandleFunc("/auth/url", allowMethods(s.makeHttpHandleFunc(s.handleAuthUrl), http.MethodGet))
+	router.HandleFunc("/auth/callback", allowMethods(withRateLimit(s.authLimiter, s.handleAuthCallback), http.MethodGet))
 
-	w.WriteHeader(http.StatusOK)
-	fmt.Fprint(w, contentStr)
-	return nil
+	router.HandleFunc("/view/{viewName}", allowMethods(s.makeViewHandleFunc(s.handleView), http.MethodGet, http.MethodHead))
+	router.HandleFunc("/view/account/{id}", s.withJwtAuth(allowMethods(s.makeViewHandleFunc(s.handleAccountView), http.MethodGet, http.MethodHead)))
+
+	router.HandleFunc("/account", allowMethods(withRateLimit(s.authLimiter, s.makeHttpHandleFunc(s.handleAccounts), http.MethodPost), http.MethodGet, http.MethodPost))
+	// the number goes in the query: /account/by-number/{number} would clash
+	// with every /account/{id}/... route
+	router.HandleFunc("/account/by-number", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleGetAccountByNumber), http.MethodGet)))
+	router.HandleFunc("/account/{id}", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleOneAccount),
+		http.MethodGet, http.MethodHead, http.MethodPut, http.MethodPatch, http.MethodDelete)))
+	router.HandleFunc("/account/{id}/deposit", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleDeposit), http.MethodPost)))
+	router.HandleFunc("/account/{id}/withdraw", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleWithdraw), http.MethodPost)))
+	router.HandleFunc("/account/{id}/transactions", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleAccountTransactions), http.MethodGet)))
+	router.HandleFunc("/account/{id}/verification", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleRequestVerification), http.MethodPost)))
+	router.HandleFunc("/verify-email", allowMethods(s.makeHttpHandleFunc(s.handleVerifyEmail), http.MethodGet))
+	router.HandleFunc("/account/{id}/snapshot", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleGetSnapshot), http.MethodGet)))
+	router.HandleFunc("/account/{id}/statement", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleStatement), http.MethodGet)))
+	router.HandleFunc("/account/{id}/low-balance-threshold", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleSetLowBalanceThreshold), http.MethodPut)))
+	router.HandleFunc("/account/{id}/whitelist", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleWhitelist), whitelistMethods...)))
+	router.HandleFunc("/account/{id}/whitelist/{number}", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleRemoveFromWhitelist), http.MethodDelete)))
+
+	router.HandleFunc("/transfer", s.withJwtAuth(allowMethods(withSemaphore(s.transferSlots, s.makeHttpHandleFunc(s.handleTransfer)), http.MethodPost)))
+
+	router.HandleFunc("/logout", allowMethods(s.makeHttpHandleFunc(s.handleLogout), http.MethodPost))
+	router.HandleFunc("/me", s.withSession(allowMethods(s.makeHttpHandleFunc(s.handleMe), http.MethodGet)))
+	router.HandleFunc("/me/sessions/revoke-all", s.withJwtAuth(allowMethods(s.makeHttpHandleFunc(s.handleRevokeAllTokens), http.MethodPost)))
+	router.HandleFunc("/token/validate", allowMethods(s.makeHttpHandleFunc(s.handleValidateToken), http.MethodGet, http.MethodPost))
+
+	router.HandleFunc("/admin/interest", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleApplyInterest), http.MethodPost)))
+	router.HandleFunc("/admin/reconcile", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleReconcile), http.MethodGet)))
+	router.HandleFunc("/admin/accounts", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleAdminCreateAccount), http.MethodPost)))
+	router.HandleFunc("/admin/accounts/{id}", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleAdminDeleteAccount), http.MethodDelete)))
+	router.HandleFunc("/admin/accounts/{id}/whitelist", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleWhitelist), whitelistMethods...)))
+	router.HandleFunc("/admin/accounts/{id}/whitelist/{number}", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleRemoveFromWhitelist), http.MethodDelete)))
+	router.HandleFunc("/admin/accounts/export", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleExportAccounts), http.MethodGet)))
+	router.HandleFunc("/admin/accounts/modified", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleModifiedAccounts), http.MethodGet)))
+	router.HandleFunc("/admin/snapshots", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleTakeSnapshot), http.MethodPost)))
+	router.HandleFunc("/admin/transactions/archive", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleArchiveTransactions), http.MethodPost)))
+	router.HandleFunc("/admin/transfers/recent", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleRecentTransactions), http.MethodGet)))
+	router.HandleFunc("/admin/discord-users", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleListDiscordUsers), http.MethodGet)))
+	router.HandleFunc("/admin/discord-users/inactive", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleListInactiveDiscordUsers), http.MethodGet)))
+	router.HandleFunc("/admin/discord-users/inactive/deactivate", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleDeactivateInactiveDiscordUsers), http.MethodPost)))
+	router.HandleFunc("/admin/reports/transfers/daily", s.withAdminAuth(allowMethods(s.makeHttpHandleFunc(s.handleDailyTransferReport), http.MethodGet)))
+
+	return router
 }
 
-func handleWholeView(w http.ResponseWriter, mainContent []byte) error {
-	t, err := template.New("index.gohtml").ParseFiles("./templ/index.gohtml")
+// handleLogout ends the browser's session, and every other session of the
+// same user, which withSession refuses from then on. It's fine to call when
+// already signed out.
+func (s *ApiServer) handleLogout(w http.ResponseWriter, r *http.Request) error {
+	s.clearAuthCookie(w, r)
+	if discordId, _, err := s.readSession(r); err == nil {
+		if err := s.store.SignOutDiscordUser(r.Context(), discordId); err != nil {
+			return err
+		}
+		s.logger.InfoContext(r.Context(), "signed out", "discord_id", discordId)
+	}
+	return WriteJson(w, http.StatusOK, nil)
+}
+
+// handleMe describes the discord user signed in on this browser
+func (s *ApiServer) handleMe(w http.ResponseWriter, r *http.Request) error {
+	user, err := s.store.GetDiscordUser(r.Context(), sessionUser(r))
 	if err != nil {
 		return err
 	}
-	w.WriteHeader(http.StatusOK)
-	return t.Execute(w, template.HTML(mainContent))
+	if user == nil {
+		// signed by us, but the user has since been removed
+		return httpErrorf(http.StatusUnauthorized, "%s", ErrNoSession)
+	}
+
+	return WriteJson(w, http.StatusOK, map[string]any{
+		"id":         user.Id,
+		"globalName": user.GlobalName,
+		"avatarUrl":  s.avatars.Resolve(r.Context(), user),
+		"lastSignIn": user.LastSignIn,
+	})
 }
 
-func (s *ApiServer) handleAccounts(w http.ResponseWriter, r *http.Request) error {
-	switch r.Method {
-	case http.MethodGet:
-		return s.handleGetAllAccounts(w, r)
-	case http.MethodPost:
-		return s.handleCreateAccount(w, r)
+// healthCheckTimeout keeps a health check from hanging on a database that
+// isn't answering; the orchestrator polling it will just ask again
+const healthCheckTimeout = 2 * time.Second
+
+// handleHealthz reports whether the service is up and can reach its database.
+// It's polled often, so it does no more than a ping.
+func (s *ApiServer) handleHealthz(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	if err := s.store.Ping(ctx); err != nil {
+		s.logger.WarnContext(r.Context(), "health check failed", "err", err)
+		return WriteJson(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "reason": "database unreachable"})
 	}
-	return fmt.Errorf("method not allowed: %s", r.Method)
+	return WriteJson(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
-func (s *ApiServer) handleOneAccount(w http.ResponseWriter, r *http.Request) error {
-	idStr := r.PathValue("id")
-	id, err := strconv.Atoi(idStr)
+// handleReadyz is handleHealthz plus a check that the schema is in place, so
+// traffic isn't sent to an instance pointed at an uninitialized database.
+func (s *ApiServer) handleReadyz(w http.ResponseWriter, r *http.Request) error {
+	ctx, cancel := context.WithTimeout(r.Context(), healthCheckTimeout)
+	defer cancel()
+
+	missing, err := s.store.MissingTables(ctx)
 	if err != nil {
-		return fmt.Errorf("invalid id given: %s", idStr)
+		s.logger.WarnContext(r.Context(), "readiness check failed", "err", err)
+		return WriteJson(w, http.StatusServiceUnavailable, map[string]string{"status": "unavailable", "reason": "database unreachable"})
 	}
-	switch r.Method {
-	case http.MethodGet:
-		return s.handleGetAccount(w, r, id)
-	case http.MethodDelete:
-		return s.handleDeleteAccount(w, r, id)
+	if len(missing) > 0 {
+		return WriteJson(w, http.StatusServiceUnavailable, map[string]string{
+			"status": "unavailable",
+			"reason": "missing tables: " + strings.Join(missing, ", "),
+		})
 	}
-	return fmt.Errorf("method not allowed: %s", r.Method)
+	return WriteJson(w, http.StatusOK, map[string]string{"status": "ok"})
 }
 
-func (s *ApiServer) handleGetAllAccounts(w http.ResponseWriter, r *http.Request) error {
-	accounts, err := s.store.GetAccounts(r.Context())
-	if err != nil {
+// handleValidateToken lets a client check a stored token without doing
+// anything else with it.
+func (s *ApiServer) handleValidateToken(w http.ResponseWriter, r *http.Request) error {
+	claims, _, err := s.authenticate(r)
+	if err != nil && !isTokenRejection(err) {
 		return err
 	}
-	return WriteJson(w, http.StatusOK, &accounts)
-}
-
-func (s *ApiServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
-	accRequest := &CreateAccountRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&accRequest); err != nil {
-		return err
+	if err != nil {
+		return codedErrorf(http.StatusUnauthorized, tokenErrorCode(err), "%s", err.Error())
 	}
 
-	account := NewAccount(accRequest.FirstName, accRequest.LastName)
-	dbAccount, err := s.store.CreateAccount(r.Context(), account)
-	if err != nil {
-		return err
+	// only echo back the claims a client has any business reading
+	public := map[string]any{}
+	for _, name := range []string{"accountNumber", "exp", "iat"} {
+		if v, ok := claims[name]; ok {
+			public[name] = v
+		}
 	}
+	return WriteJson(w, http.StatusOK, map[string]any{"valid": true, "claims": public})
+}
 
-	tokenStr, err := createJwt(account)
+// handleRevokeAllTokens signs the caller out everywhere by invalidating every
+// token issued for their account. With RevokeKeepsCurrent the caller gets a
+// fresh token back so this device stays signed in.
+func (s *ApiServer) handleRevokeAllTokens(w http.ResponseWriter, r *http.Request) error {
+	account := authedAccount(r)
+	epoch, err := s.store.RevokeTokens(r.Context(), account.Id)
+	if errors.Is(err, ErrAccountNotFound) {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	}
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("JWT Token: %s\n", tokenStr)
-
-	return WriteJson(w, http.StatusOK, dbAccount)
+	res := map[string]any{"revoked": true}
+	if s.config.RevokeKeepsCurrent {
+		account.TokenEpoch = epoch
+		token, err := s.createJwt(account)
+		if err != nil {
+			return err
+		}
+		res["token"] = token
+	}
+	return WriteJson(w, http.StatusOK, res)
 }
 
-func (s *ApiServer) handleGetAccount(w http.ResponseWriter, r *http.Request, id int) error {
-	account, err := s.store.GetAccountById(r.Context(), id)
+// handleAuthUrl is /login for single page apps: fetch can't follow the
+// redirect, so hand over the url and let the app send the browser there.
+func (s *ApiServer) handleAuthUrl(w http.ResponseWriter, r *http.Request) error {
+	state, err := s.issueOAuthState(w, r)
 	if err != nil {
 		return err
 	}
-	if account == nil {
-		return WriteJson(w, http.StatusNotFound, nil)
-	}
-
-	return WriteJson(w, http.StatusOK, account)
+	return WriteJson(w, http.StatusOK, map[string]string{"url": s.auth.AuthCodeURL(state)})
 }
 
-func (s *ApiServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request, id int) error {
-	if err := s.store.DeleteAccount(r.Context(), id); err != nil {
-		return err
+func (s *ApiServer) handleAuthCallback(w http.ResponseWriter, r *http.Request) {
+	if !s.checkOAuthState(w, r) {
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("State does not match."))
+		return
 	}
-	return WriteJson(w, http.StatusOK, nil)
-}
 
-func (s *ApiServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
-	transferRequest := &TransferRequest{}
-	if err := json.NewDecoder(r.Body).Decode(&transferRequest); err != nil {
-		return err
+	token, err := s.auth.Exchange(r.Context(), r.FormValue("code"))
+	if err != nil {
+		quickErr(w, err)
+		return
+	}
+
+	res, err := s.auth.Client(r.Context(), token).Get("https://discord.com/api/users/@me")
+	if err != nil || res.StatusCode != 200 {
+		w.WriteHeader(http.StatusInternalServerError)
+		if err != nil {
+			w.Write([]byte(err.Error()))
+		} else {
+			w.Write([]byte(res.Status))
+		}
+		return
+	}
+	defer res.Body.Close()
+
+	user := &DiscordUser{}
+	if err := json.NewDecoder(res.Body).Decode(&user); err != nil {
+		quickErr(w, err)
+		return
+	}
+
+	// warm the avatar cache off to the side, so the cdn can't hold up the login
+	s.avatars.Warm(r.Context(), user)
+
+	firstLogin, err := s.store.UpsertDiscordUser(r.Context(), user)
+	if err != nil {
+		quickErr(w, err)
+		return
+	}
+
+	correlationId, err := s.issueSession(w, r, user.Id)
+	if err != nil {
+		quickErr(w, err)
+		return
+	}
+	// this request came in without the session, so it has to be logged by
+	// hand for the login to start the session's trail
+	s.logger.InfoContext(r.Context(), "signed in",
+		"correlation_id", correlationId,
+		"discord_id", user.Id,
+		"first_login", firstLogin,
+	)
+
+	// first timers get the welcome view, told it's their first visit
+	if firstLogin {
+		http.Redirect(w, r, s.config.WelcomePath+"?firstLogin=true", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func quickErr(w http.ResponseWriter, err error) {
+	w.WriteHeader(http.StatusInternalServerError)
+	w.Write([]byte(err.Error()))
+}
+
+// disabled answers for the routes of a feature that's switched off, with
+// DisabledStatus rather than a 404, so clients can tell "off" from "never
+// existed".
+func (s *ApiServer) disabled(feature string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		WriteJson(w, s.config.DisabledStatus, newApiError(CodeFeatureDisabled, fmt.Sprintf("%s is disabled on this server", feature)))
+	}
+}
+
+// noDotfiles 404s any path with a segment starting with a dot, so things
+// like .env or .git can never be served out of the static dir.
+func noDotfiles(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, part := range strings.Split(r.URL.Path, "/") {
+			if strings.HasPrefix(part, ".") {
+				http.NotFound(w, r)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// handleHome is / and renders the home view like any other, layout included
+func (s *ApiServer) handleHome(w http.ResponseWriter, r *http.Request) error {
+	return s.renderView(w, r, "home", viewData{})
+}
+
+func (s *ApiServer) handleView(w http.ResponseWriter, r *http.Request) error {
+	return s.renderView(w, r, r.PathValue("viewName"), viewData{
+		FirstLogin: r.URL.Query().Get("firstLogin") == "true",
+	})
+}
+
+// viewNameRe is what a view name may look like: a plain file name, so no
+// separators, no dots and nothing hidden
+var viewNameRe = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// notFoundView stands in for views that don't exist
+const notFoundView = "notfound"
+
+// viewData is what views get to work with. Views only use what they need,
+// so most get it empty.
+type viewData struct {
+	// Account is the signed in account, for the account view
+	Account *Account
+	// FirstLogin is set on the redirect after a user's first sign in, see
+	// handleAuthCallback
+	FirstLogin bool
+}
+
+// renderView executes the named view with data: just the fragment for htmx
+// requests, wrapped in the layout for everything else
+func (s *ApiServer) renderView(w http.ResponseWriter, r *http.Request, viewName string, data viewData) error {
+	if !viewNameRe.MatchString(viewName) {
+		return httpErrorf(http.StatusBadRequest, "invalid view name")
+	}
+	view := s.views.Lookup(viewName + ".gohtml")
+	if view == nil {
+		view = s.views.Lookup(notFoundView + ".gohtml")
+	}
+	var content bytes.Buffer
+	if err := view.Execute(&content, data); err != nil {
+		return err
+	}
+
+	// if this is not an htmx request, we need to provide the rest of the layout
+	if r.Header.Get("Hx-Request") == "" {
+		return s.handleWholeView(w, content.Bytes())
+	}
+
+	WriteHtml(w, http.StatusOK, content.String())
+	return nil
+}
+
+// handleAccountView shows the signed in account
+func (s *ApiServer) handleAccountView(w http.ResponseWriter, r *http.Request) error {
+	return s.renderView(w, r, "account", viewData{Account: authedAccount(r)})
+}
+
+func (s *ApiServer) handleWholeView(w http.ResponseWriter, mainContent []byte) error {
+	var page bytes.Buffer
+	if err := s.templates.ExecuteTemplate(&page, layoutTemplate, template.HTML(mainContent)); err != nil {
+		return err
+	}
+	WriteHtml(w, http.StatusOK, page.String())
+	return nil
+}
+
+// handleAccounts lists (GET) or opens (POST) accounts. allowMethods turns
+// away anything else before it gets here.
+func (s *ApiServer) handleAccounts(w http.ResponseWriter, r *http.Request) error {
+	if r.Method == http.MethodGet {
+		// finding accounts by their owner's name is for the back office only
+		if r.URL.Query().Get("q") != "" {
+			s.withAdminAuth(s.makeHttpHandleFunc(s.handleGetAllAccounts))(w, r)
+			return nil
+		}
+		return s.handleGetAllAccounts(w, r)
+	}
+	return s.handleCreateAccount(w, r)
+}
+
+// handleOneAccount dispatches on method, which allowMethods has already
+// narrowed down to the ones below
+func (s *ApiServer) handleOneAccount(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+	switch r.Method {
+	case http.MethodGet:
+		return s.handleGetAccount(w, r, id)
+	case http.MethodHead:
+		return s.handleAccountExists(w, r, id)
+	case http.MethodPut, http.MethodPatch:
+		return s.handleUpdateAccount(w, r, id)
+	}
+	return s.handleDeleteAccount(w, r, id)
+}
+
+// handleGetAllAccounts pages through the accounts, or with ?q= through those
+// whose first or last name contains it. handleAccounts only lets admins
+// search.
+func (s *ApiServer) handleGetAllAccounts(w http.ResponseWriter, r *http.Request) error {
+	fields, err := parseAccountFields(r)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+	limit, offset, err := parsePagination(r, s.config.MaxPageOffset)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	var accounts []*Account
+	var total int64
+	if q := r.URL.Query().Get("q"); q != "" {
+		accounts, total, err = s.store.SearchAccounts(r.Context(), q, limit, offset)
+	} else {
+		accounts, total, err = s.store.GetAccounts(r.Context(), limit, offset)
+	}
+	if err != nil {
+		return err
+	}
+	page := &AccountPage{Total: total, Limit: limit, Offset: offset}
+	if fields == nil {
+		page.Accounts = accounts
+		return WriteJson(w, http.StatusOK, page)
+	}
+
+	partials := make([]map[string]json.RawMessage, 0, len(accounts))
+	for _, account := range accounts {
+		partial, err := selectAccountFields(account, fields)
+		if err != nil {
+			return err
+		}
+		partials = append(partials, partial)
+	}
+	page.Accounts = partials
+	return WriteJson(w, http.StatusOK, page)
+}
+
+func (s *ApiServer) handleCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	dbAccount, err := s.createAccount(w, r)
+	if err != nil {
+		return err
+	}
+
+	// signed from what was stored, so the token is for the account as the
+	// database has it
+	token, err := s.createJwt(dbAccount)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "created account", "account", dbAccount)
+
+	return WriteJson(w, http.StatusOK, &CreateAccountResponse{Account: dbAccount, Token: token})
+}
+
+// handleAdminCreateAccount opens an account from the back office. It's
+// validated like any other, but no token is handed out since the admin
+// isn't the account's owner, and an audit line records who opened it.
+func (s *ApiServer) handleAdminCreateAccount(w http.ResponseWriter, r *http.Request) error {
+	dbAccount, err := s.createAccount(w, r)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "audit",
+		"actor", "admin",
+		"action", "account.create",
+		"account_id", dbAccount.Id,
+		"balance", dbAccount.Balance,
+		"remote_addr", r.RemoteAddr,
+	)
+	return WriteJson(w, http.StatusOK, dbAccount)
+}
+
+// accountNumberAttempts is how many random numbers createAccount tries.
+// Running out would take a lot of accounts or a lot of bad luck.
+const accountNumberAttempts = 5
+
+// createAccount opens the account described by the request body, with its
+// initial deposit if it has one
+func (s *ApiServer) createAccount(w http.ResponseWriter, r *http.Request) (*Account, error) {
+	accRequest := &CreateAccountRequest{}
+	if err := s.decodeJSON(w, r, accRequest); err != nil {
+		return nil, err
+	}
+
+	if s.config.NormalizeNames {
+		accRequest.FirstName = normalizeName(accRequest.FirstName)
+		accRequest.LastName = normalizeName(accRequest.LastName)
+	}
+
+	if err := s.checkNames(accRequest.FirstName, accRequest.LastName); err != nil {
+		return nil, err
+	}
+
+	if accRequest.InitialDeposit < 0 {
+		return nil, httpErrorf(http.StatusBadRequest, "initialDeposit cannot be negative")
+	}
+
+	var err error
+	account := NewAccount(accRequest.FirstName, accRequest.LastName)
+	if account.Currency = strings.ToUpper(accRequest.Currency); account.Currency == "" {
+		account.Currency = s.config.DefaultCurrency
+	}
+	if !validCurrency(account.Currency) {
+		return nil, &ValidationError{Fields: map[string]string{"currency": "must be an ISO 4217 currency code"}}
+	}
+	if account.Email, err = parseEmail(accRequest.Email); err != nil {
+		return nil, err
+	}
+	if accRequest.ExternalId != "" {
+		// whoever names an existing account's key gets that account back, so
+		// only the back office may
+		if !s.isAdmin(r) {
+			return nil, codedErrorf(http.StatusForbidden, CodeAdminRequired, "externalId is for admin imports")
+		}
+		account.ExternalId = &accRequest.ExternalId
+	}
+	if account.Sandbox, err = s.sandboxRequested(r); err != nil {
+		return nil, err
+	}
+	var dbAccount *Account
+	var dupErr *DuplicateError
+	// a clash on the random number just means drawing another one
+	for attempt := 0; attempt < accountNumberAttempts; attempt++ {
+		if attempt > 0 {
+			account.Number = newAccountNumber()
+			s.logger.WarnContext(r.Context(), "account number taken, retrying", "attempt", attempt+1)
+		}
+		if accRequest.InitialDeposit > 0 {
+			dbAccount, err = s.store.CreateAccountWithDeposit(r.Context(), account, int64(accRequest.InitialDeposit))
+		} else {
+			dbAccount, err = s.store.CreateAccount(r.Context(), account)
+		}
+		if !errors.As(err, &dupErr) || dupErr.Field != "number" {
+			break
+		}
+	}
+	if errors.As(err, &dupErr) && dupErr.Field == "externalId" {
+		existing, lookupErr := s.store.GetAccountByExternalId(r.Context(), accRequest.ExternalId)
+		if lookupErr != nil {
+			return nil, lookupErr
+		}
+		// nil when the key belongs to a deleted account, which stays a conflict
+		if existing != nil {
+			s.logger.InfoContext(r.Context(), "account already imported", "account_id", existing.Id, "external_id", accRequest.ExternalId)
+			return existing, nil
+		}
+	}
+	if errors.As(err, &dupErr) {
+		return nil, httpErrorf(http.StatusConflict, "%s", dupErr.Error())
+	}
+	if errors.Is(err, ErrBalanceOutOfRange) {
+		return nil, codedErrorf(http.StatusBadRequest, CodeBalanceOutOfRange, "%s", err.Error())
+	}
+	return dbAccount, err
+}
+
+// sandboxRequested is whether the caller asked for a sandbox account, with
+// the X-Sandbox header or ?sandbox=true. Asking is refused outright while
+// SANDBOX_ACCOUNTS is off, so a test run can't open real accounts unawares.
+func (s *ApiServer) sandboxRequested(r *http.Request) (bool, error) {
+	value := r.Header.Get("X-Sandbox")
+	if value == "" {
+		value = r.URL.Query().Get("sandbox")
+	}
+	if value == "" {
+		return false, nil
+	}
+	sandbox, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, httpErrorf(http.StatusBadRequest, "sandbox must be true or false")
+	}
+	if sandbox && !s.config.SandboxAccounts {
+		return false, codedErrorf(s.config.DisabledStatus, CodeFeatureDisabled, "sandbox accounts are disabled on this server")
+	}
+	return sandbox, nil
+}
+
+// parseEmail checks an email address from a request, returning nil for an
+// empty one. Display names are dropped: "Ada <ada@example.com>" is stored
+// as ada@example.com.
+func parseEmail(email string) (*string, error) {
+	if email == "" {
+		return nil, nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil {
+		return nil, &ValidationError{Fields: map[string]string{"email": "must be an email address"}}
+	}
+	return &addr.Address, nil
+}
+
+// checkNames holds an account's names up against the NameLength policy
+func (s *ApiServer) checkNames(firstName, lastName string) error {
+	fields := map[string]string{}
+	if problem := s.config.NameLength.Check(firstName); problem != "" {
+		fields["firstName"] = problem
+	}
+	if problem := s.config.NameLength.Check(lastName); problem != "" {
+		fields["lastName"] = problem
+	}
+	if len(fields) > 0 {
+		return &ValidationError{Fields: fields}
+	}
+	return nil
+}
+
+func (s *ApiServer) handleGetAccount(w http.ResponseWriter, r *http.Request, id int) error {
+	fields, err := parseAccountFields(r)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	account, err := s.store.GetAccountById(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	if fields == nil {
+		return WriteJson(w, http.StatusOK, account)
+	}
+
+	partial, err := selectAccountFields(account, fields)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, partial)
+}
+
+// handleAccountExists answers HEAD with 200 or 404 and no body, for clients
+// that only need to know the id is there
+func (s *ApiServer) handleAccountExists(w http.ResponseWriter, r *http.Request, id int) error {
+	exists, err := s.store.AccountExists(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		w.WriteHeader(http.StatusNotFound)
+		return nil
+	}
+	w.WriteHeader(http.StatusOK)
+	return nil
+}
+
+// handleGetAccountByNumber resolves ?number= to its account, for clients
+// that only hold the number from their token. Like the routes by id it's
+// only for the account's owner.
+func (s *ApiServer) handleGetAccountByNumber(w http.ResponseWriter, r *http.Request) error {
+	number, err := strconv.ParseInt(r.URL.Query().Get("number"), 10, 64)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid account number: %s", r.URL.Query().Get("number"))
+	}
+	if number != authedAccount(r).Number {
+		return codedErrorf(http.StatusForbidden, CodeNotYourAccount, "not your account")
+	}
+
+	account, err := s.store.GetAccountByNumber(r.Context(), number)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	return WriteJson(w, http.StatusOK, account)
+}
+
+// accountFields are the json names a client may ask for via ?fields=
+var accountFields = map[string]bool{
+	"id":        true,
+	"firstName": true,
+	"lastName":  true,
+	"number":    true,
+	"balance":   true,
+	"createdAt": true,
+	"updatedAt": true,
+
+	"lowBalanceThreshold": true,
+}
+
+// parseAccountFields reads the comma separated ?fields= param.
+// A nil slice means no selection was asked for, so send the whole account.
+func parseAccountFields(r *http.Request) ([]string, error) {
+	raw := r.URL.Query().Get("fields")
+	if raw == "" {
+		return nil, nil
+	}
+
+	fields := []string{}
+	for _, field := range strings.Split(raw, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if !accountFields[field] {
+			return nil, fmt.Errorf("unknown field: %s", field)
+		}
+		fields = append(fields, field)
+	}
+	return fields, nil
+}
+
+// selectAccountFields goes through the account's own json encoding so the
+// partial keys and values always match what a full read would return.
+func selectAccountFields(account *Account, fields []string) (map[string]json.RawMessage, error) {
+	b, err := json.Marshal(account)
+	if err != nil {
+		return nil, err
+	}
+	all := map[string]json.RawMessage{}
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+
+	partial := make(map[string]json.RawMessage, len(fields))
+	for _, field := range fields {
+		partial[field] = all[field]
+	}
+	return partial, nil
+}
+
+// handleUpdateAccount renames the account, answering with the account as it
+// is afterwards. A version the account has moved on from gets a 409.
+func (s *ApiServer) handleUpdateAccount(w http.ResponseWriter, r *http.Request, id int) error {
+	updateRequest := &UpdateAccountRequest{}
+	if err := s.decodeJSON(w, r, updateRequest); err != nil {
+		return err
+	}
+	if r.Method == http.MethodPut && (updateRequest.FirstName == nil || updateRequest.LastName == nil) {
+		return httpErrorf(http.StatusBadRequest, "firstName and lastName are required")
+	}
+
+	account, err := s.store.GetAccountById(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+
+	// without a version from the client this still stops a write landing
+	// between our read and our update being undone
+	if updateRequest.Version != nil {
+		account.Version = *updateRequest.Version
+	}
+	if updateRequest.FirstName != nil {
+		account.FirstName = *updateRequest.FirstName
+	}
+	if updateRequest.LastName != nil {
+		account.LastName = *updateRequest.LastName
+	}
+	if updateRequest.Email != nil {
+		if account.Email, err = parseEmail(*updateRequest.Email); err != nil {
+			return err
+		}
+	}
+	if s.config.NormalizeNames {
+		account.FirstName = normalizeName(account.FirstName)
+		account.LastName = normalizeName(account.LastName)
+	}
+	if err := s.checkNames(account.FirstName, account.LastName); err != nil {
+		return err
+	}
+	updated, err := s.store.UpdateAccount(r.Context(), account)
+	var dupErr *DuplicateError
+	if errors.As(err, &dupErr) {
+		return httpErrorf(http.StatusConflict, "%s", dupErr.Error())
+	}
+	if errors.Is(err, ErrVersionConflict) {
+		return codedErrorf(http.StatusConflict, CodeVersionConflict, "%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if updated == nil {
+		// deleted between the read and the update
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	return WriteJson(w, http.StatusOK, updated)
+}
+
+// handleDeleteAccount soft deletes the account, keeping its row and history.
+// Admins can pass ?hard=true to remove it for good.
+func (s *ApiServer) handleDeleteAccount(w http.ResponseWriter, r *http.Request, id int) error {
+	hard := false
+	if hardStr := r.URL.Query().Get("hard"); hardStr != "" {
+		var err error
+		if hard, err = strconv.ParseBool(hardStr); err != nil {
+			return httpErrorf(http.StatusBadRequest, "hard must be true or false")
+		}
+	}
+	if hard && !s.isAdmin(r) {
+		s.logAuthDecision(r, "anonymous", false, "hard delete without admin token")
+		return codedErrorf(http.StatusForbidden, CodeAdminRequired, "only admins can hard delete accounts")
+	}
+
+	err := s.store.DeleteAccount(r.Context(), id, hard)
+	if errors.Is(err, ErrAccountNotFound) {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	if hard {
+		s.logger.InfoContext(r.Context(), "admin hard deleted account", "account_id", id)
+	}
+	return WriteJson(w, http.StatusOK, nil)
+}
+
+// handleAdminDeleteAccount is handleDeleteAccount for admins, who don't hold
+// the owner's token
+func (s *ApiServer) handleAdminDeleteAccount(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+	return s.handleDeleteAccount(w, r, id)
+}
+
+func (s *ApiServer) handleDeposit(w http.ResponseWriter, r *http.Request) error {
+	return s.handleBalanceChange(w, r, s.store.Deposit)
+}
+
+func (s *ApiServer) handleWithdraw(w http.ResponseWriter, r *http.Request) error {
+	return s.handleBalanceChange(w, r, s.store.Withdraw)
+}
+
+// handleBalanceChange reads {amount, version} and applies it to the account
+// with change, answering with the new balance
+func (s *ApiServer) handleBalanceChange(w http.ResponseWriter, r *http.Request, change func(context.Context, int, int64, *int64) (int64, error)) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+	changeRequest := &BalanceChangeRequest{}
+	if err := s.decodeJSON(w, r, changeRequest); err != nil {
+		return err
+	}
+	if changeRequest.Amount <= 0 {
+		return httpErrorf(http.StatusBadRequest, "amount must be greater than 0")
+	}
+
+	balance, err := change(r.Context(), id, int64(changeRequest.Amount), changeRequest.Version)
+	switch {
+	case errors.Is(err, ErrVersionConflict):
+		return codedErrorf(http.StatusConflict, CodeVersionConflict, "%s", err.Error())
+	case errors.Is(err, ErrAccountNotFound):
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	case errors.Is(err, ErrInsufficientFunds):
+		return codedErrorf(http.StatusUnprocessableEntity, CodeInsufficientFunds, "%s", err.Error())
+	case errors.Is(err, ErrBalanceOutOfRange):
+		return codedErrorf(http.StatusBadRequest, CodeBalanceOutOfRange, "%s", err.Error())
+	case err != nil:
+		return err
+	}
+
+	s.alertLowBalances(r.Context(), id)
+	return WriteJson(w, http.StatusOK, map[string]int64{"balance": balance})
+}
+
+// handleAccountTransactions lists the account's ledger entries, newest first,
+// a page at a time. ?includeArchived=true adds the archived ones.
+func (s *ApiServer) handleAccountTransactions(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+	limit, offset, err := parsePagination(r, s.config.MaxPageOffset)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	// archived entries are slower to reach, so they're opt in
+	includeArchived := r.URL.Query().Get("includeArchived") == "true"
+	entries, err := s.store.GetAccountTransactions(r.Context(), id, limit, offset, includeArchived)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, entries)
+}
+
+// handleStatement sends the account's statement for ?from= to ?to= as a pdf
+// download.
+func (s *ApiServer) handleStatement(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	account, err := s.store.GetAccountById(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+
+	// to is the last day included, the store wants the moment after it
+	statement, err := s.store.GetStatement(r.Context(), id, from, to.AddDate(0, 0, 1))
+	if errors.Is(err, ErrAccountNotFound) {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	pdf, err := renderStatementPdf(account, statement)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/pdf")
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="statement-%d-%s-%s.pdf"`,
+		account.Number, from.Format(time.DateOnly), to.Format(time.DateOnly)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(pdf)))
+	w.WriteHeader(http.StatusOK)
+	_, err = w.Write(pdf)
+	return err
+}
+
+// handleGetSnapshot answers with the account's balance as of its latest
+// snapshot at or before ?at= (RFC 3339, default now)
+func (s *ApiServer) handleGetSnapshot(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+	at := time.Now()
+	if atStr := r.URL.Query().Get("at"); atStr != "" {
+		if at, err = time.Parse(time.RFC3339, atStr); err != nil {
+			return httpErrorf(http.StatusBadRequest, "at must be an RFC 3339 time")
+		}
+	}
+
+	snapshot, err := s.store.GetSnapshot(r.Context(), id, at)
+	if err != nil {
+		return err
+	}
+	if snapshot == nil {
+		return httpErrorf(http.StatusNotFound, "no snapshot of account %d at or before %s", id, at.Format(time.RFC3339))
+	}
+	return WriteJson(w, http.StatusOK, snapshot)
+}
+
+// handleTakeSnapshot records every account's balance, for end of day
+// reporting. It's meant to be called on a schedule, e.g. from cron.
+func (s *ApiServer) handleTakeSnapshot(w http.ResponseWriter, r *http.Request) error {
+	run, err := s.store.TakeBalanceSnapshot(r.Context())
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "took balance snapshot", "accounts", run.Accounts, "taken_at", run.TakenAt)
+	return WriteJson(w, http.StatusCreated, run)
+}
+
+var whitelistMethods = []string{http.MethodGet, http.MethodPut, http.MethodPost}
+
+// handleWhitelist shows (GET), switches on or off (PUT) or adds to (POST) an
+// account's transfer whitelist. Owners reach it under /account, admins under
+// /admin/accounts.
+func (s *ApiServer) handleWhitelist(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		enabledRequest := &WhitelistEnabledRequest{}
+		if err := s.decodeJSON(w, r, enabledRequest); err != nil {
+			return err
+		}
+		if enabledRequest.Enabled == nil {
+			return httpErrorf(http.StatusBadRequest, "enabled is required")
+		}
+		err = s.store.SetTransferWhitelistEnabled(r.Context(), id, *enabledRequest.Enabled)
+	case http.MethodPost:
+		entryRequest := &WhitelistEntryRequest{}
+		if err := s.decodeJSON(w, r, entryRequest); err != nil {
+			return err
+		}
+		// only real accounts, so a typo doesn't quietly approve nothing
+		destination, lookupErr := s.store.GetAccountByNumber(r.Context(), entryRequest.Number)
+		if lookupErr != nil {
+			return lookupErr
+		}
+		if destination == nil {
+			return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "no account has number %d", entryRequest.Number)
+		}
+		err = s.store.AddToTransferWhitelist(r.Context(), id, entryRequest.Number)
+	}
+	if errors.Is(err, ErrAccountNotFound) {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+
+	whitelist, err := s.store.GetTransferWhitelist(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if whitelist == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	return WriteJson(w, http.StatusOK, whitelist)
+}
+
+// handleRemoveFromWhitelist takes a number off an account's whitelist
+func (s *ApiServer) handleRemoveFromWhitelist(w http.ResponseWriter, r *http.Request) error {
+	id, err := strconv.Atoi(r.PathValue("id"))
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", r.PathValue("id"))
+	}
+	number, err := strconv.ParseInt(r.PathValue("number"), 10, 64)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid account number: %s", r.PathValue("number"))
+	}
+
+	if err := s.store.RemoveFromTransferWhitelist(r.Context(), id, number); err != nil {
+		return err
+	}
+	whitelist, err := s.store.GetTransferWhitelist(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if whitelist == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	return WriteJson(w, http.StatusOK, whitelist)
+}
+
+func (s *ApiServer) handleSetLowBalanceThreshold(w http.ResponseWriter, r *http.Request) error {
+	idStr := r.PathValue("id")
+	id, err := strconv.Atoi(idStr)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "invalid id given: %s", idStr)
+	}
+
+	thresholdRequest := &LowBalanceThresholdRequest{}
+	if err := s.decodeJSON(w, r, &thresholdRequest); err != nil {
+		return err
+	}
+
+	err = s.store.SetLowBalanceThreshold(r.Context(), id, thresholdRequest.Threshold)
+	if errors.Is(err, ErrAccountNotFound) {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	// the balance may already be under the new threshold
+	s.alertLowBalances(r.Context(), id)
+
+	account, err := s.store.GetAccountById(r.Context(), id)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	return WriteJson(w, http.StatusOK, account)
+}
+
+// alertLowBalances notifies about accounts that just dropped below their
+// threshold. Run it after anything that moves money. It's best effort: a
+// failed alert is logged but never fails the operation that triggered it.
+func (s *ApiServer) alertLowBalances(ctx context.Context, accountIds ...int) {
+	alerts, err := s.store.CheckLowBalances(ctx, accountIds...)
+	if err != nil {
+		s.logger.ErrorContext(ctx, "checking low balances", "err", err)
+		return
+	}
+
+	for _, alert := range alerts {
+		event := Event{
+			Kind:      EventLowBalance,
+			AccountId: alert.AccountId,
+			Number:    alert.Number,
+			Balance:   alert.Balance,
+			Threshold: alert.Threshold,
+		}
+		if alert.Email != nil {
+			event.Email = *alert.Email
+		}
+		if err := s.notifier.Notify(ctx, event); err != nil {
+			s.logger.ErrorContext(ctx, "sending low balance alert", "account_id", alert.AccountId, "err", err)
+		}
+	}
+}
+
+func (s *ApiServer) handleTransfer(w http.ResponseWriter, r *http.Request) error {
+	transferRequest := &TransferRequest{}
+	if err := s.decodeJSON(w, r, transferRequest); err != nil {
+		if errors.Is(err, ErrAmountOutOfRange) {
+			return &ValidationError{Fields: map[string]string{"amount": fmt.Sprintf("must be at most %d", s.config.MaxTransferAmount)}}
+		}
+		return err
+	}
+	if transferRequest.Amount <= 0 {
+		return httpErrorf(http.StatusBadRequest, "amount must be greater than 0")
+	}
+	if transferRequest.Amount > s.config.MaxTransferAmount {
+		return &ValidationError{Fields: map[string]string{"amount": fmt.Sprintf("must be at most %d", s.config.MaxTransferAmount)}}
+	}
+
+	// ownership first, so an account that isn't yours and one that doesn't
+	// exist look the same
+	if owner := authedAccount(r); owner == nil || owner.Id != transferRequest.FromAccount {
+		return codedErrorf(http.StatusForbidden, CodeNotYourAccount, "not your account")
+	}
+	from, err := s.store.GetAccountById(r.Context(), transferRequest.FromAccount)
+	if err != nil {
+		return err
+	}
+	if from == nil {
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", ErrAccountNotFound.Error())
+	}
+	// safe to check outside the transfer, an account never goes back to
+	// unverified
+	if s.config.RequireEmailVerification && !from.EmailVerified {
+		return codedErrorf(http.StatusForbidden, CodeEmailUnverified, "%s", ErrEmailUnverified.Error())
+	}
+
+	fee := s.config.TransferFee.Fee(transferRequest.Amount)
+	balance, err := s.store.Transfer(r.Context(), from.Id, transferRequest.ToAccount, int64(transferRequest.Amount),
+		FeeCharge{Amount: int64(fee), Account: s.config.TransferFee.Account}, transferRequest.Version)
+	switch {
+	case errors.Is(err, ErrVersionConflict):
+		return codedErrorf(http.StatusConflict, CodeVersionConflict, "%s", err.Error())
+	case errors.Is(err, ErrAccountNotFound):
+		return codedErrorf(http.StatusNotFound, CodeAccountNotFound, "%s", err.Error())
+	case errors.Is(err, ErrInsufficientFunds):
+		return codedErrorf(http.StatusUnprocessableEntity, CodeInsufficientFunds, "%s", err.Error())
+	case errors.Is(err, ErrCurrencyMismatch):
+		return codedErrorf(http.StatusUnprocessableEntity, CodeCurrencyMismatch, "%s", err.Error())
+	case errors.Is(err, ErrNotWhitelisted):
+		return codedErrorf(http.StatusForbidden, CodeNotWhitelisted, "%s", err.Error())
+	case errors.Is(err, ErrSameAccount):
+		return codedErrorf(http.StatusBadRequest, CodeSameAccount, "%s", err.Error())
+	case errors.Is(err, ErrBalanceOutOfRange):
+		return codedErrorf(http.StatusBadRequest, CodeBalanceOutOfRange, "%s", err.Error())
+	case err != nil:
+		return err
+	}
+
+	s.webhooks.Send(r.Context(), EventTransferCompleted, &TransferWebhook{
+		FromAccount: from.Id,
+		ToAccount:   transferRequest.ToAccount,
+		Amount:      int64(transferRequest.Amount),
+		Fee:         int64(fee),
+	})
+	s.alertLowBalances(r.Context(), from.Id)
+	return WriteJson(w, http.StatusOK, &TransferResponse{Balance: Amount(balance), Fee: fee})
+}
+
+const (
+	defaultRecentTransactions = 50
+	maxRecentTransactions     = 500
+)
+
+func (s *ApiServer) handleRecentTransactions(w http.ResponseWriter, r *http.Request) error {
+	limit := defaultRecentTransactions
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		var err error
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxRecentTransactions {
+			return httpErrorf(http.StatusBadRequest, "limit must be between 1 and %d", maxRecentTransactions)
+		}
+	}
+
+	transfers, err := s.store.GetRecentTransactions(r.Context(), limit)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, transfers)
+}
+
+// maxReportDays keeps the daily report from generating an unbounded series
+const maxReportDays = 366
+
+// parseDateRange reads the ?from= and ?to= days (YYYY-MM-DD, both inclusive),
+// defaulting to the last 30 days. The error is fit to show the client.
+func parseDateRange(r *http.Request) (from, to time.Time, err error) {
+	to = time.Now().UTC().Truncate(24 * time.Hour)
+	from = to.AddDate(0, 0, -29)
+
+	if fromStr := r.URL.Query().Get("from"); fromStr != "" {
+		if from, err = time.Parse(time.DateOnly, fromStr); err != nil {
+			return from, to, fmt.Errorf("invalid from date, expected YYYY-MM-DD")
+		}
+	}
+	if toStr := r.URL.Query().Get("to"); toStr != "" {
+		if to, err = time.Parse(time.DateOnly, toStr); err != nil {
+			return from, to, fmt.Errorf("invalid to date, expected YYYY-MM-DD")
+		}
+	}
+	if to.Before(from) {
+		return from, to, fmt.Errorf("from must not be after to")
+	}
+	if to.Sub(from) > maxReportDays*24*time.Hour {
+		return from, to, fmt.Errorf("range cannot exceed %d days", maxReportDays)
+	}
+	return from, to, nil
+}
+
+func (s *ApiServer) handleDailyTransferReport(w http.ResponseWriter, r *http.Request) error {
+	from, to, err := parseDateRange(r)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	includeSandbox := r.URL.Query().Get("includeSandbox") == "true"
+	counts, err := s.store.GetDailyTransferCounts(r.Context(), from, to, includeSandbox)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, counts)
+}
+
+func (s *ApiServer) handleApplyInterest(w http.ResponseWriter, r *http.Request) error {
+	interestRequest := &InterestRequest{}
+	if err := s.decodeJSON(w, r, &interestRequest); err != nil {
+		return err
+	}
+
+	changed, err := s.store.ApplyInterest(r.Context(), interestRequest.Rate)
+	if errors.Is(err, ErrInvalidRate) {
+		return codedErrorf(http.StatusBadRequest, CodeInvalidRate, "%s", err.Error())
+	}
+	if errors.Is(err, ErrBalanceOutOfRange) {
+		return codedErrorf(http.StatusBadRequest, CodeBalanceOutOfRange, "%s", err.Error())
+	}
+	if err != nil {
+		return err
+	}
+	s.alertLowBalances(r.Context())
+	return WriteJson(w, http.StatusOK, map[string]int64{"accounts": changed})
+}
+
+// handleArchiveTransactions moves ledger entries from before ?before= (RFC
+// 3339) into the archive
+func (s *ApiServer) handleArchiveTransactions(w http.ResponseWriter, r *http.Request) error {
+	before, err := time.Parse(time.RFC3339, r.URL.Query().Get("before"))
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "before must be an RFC 3339 time")
+	}
+	if before.After(time.Now()) {
+		return httpErrorf(http.StatusBadRequest, "before cannot be in the future")
+	}
+
+	moved, err := s.store.ArchiveTransactionsBefore(r.Context(), before)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "archived transactions", "before", before, "moved", moved)
+	return WriteJson(w, http.StatusOK, map[string]int64{"archived": moved})
+}
+
+const (
+	defaultModifiedAccounts = 100
+	maxModifiedAccounts     = 1000
+)
+
+// handleModifiedAccounts lists accounts changed after ?since= (RFC 3339), for
+// systems that sync by polling
+func (s *ApiServer) handleModifiedAccounts(w http.ResponseWriter, r *http.Request) error {
+	since, err := time.Parse(time.RFC3339Nano, r.URL.Query().Get("since"))
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "since must be an RFC 3339 timestamp")
+	}
+
+	limit := defaultModifiedAccounts
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxModifiedAccounts {
+			return httpErrorf(http.StatusBadRequest, "limit must be between 1 and %d", maxModifiedAccounts)
+		}
+	}
+
+	accounts, err := s.store.GetAccountsModifiedSince(r.Context(), since, limit)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, accounts)
+}
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+// parsePagination reads ?limit= (1 to maxPageSize, defaultPageSize if absent)
+// and ?offset= (0 to maxOffset). The error is fit to show the client.
+func parsePagination(r *http.Request, maxOffset int) (limit, offset int, err error) {
+	limit = defaultPageSize
+	if limitStr := r.URL.Query().Get("limit"); limitStr != "" {
+		limit, err = strconv.Atoi(limitStr)
+		if err != nil || limit < 1 || limit > maxPageSize {
+			return 0, 0, fmt.Errorf("limit must be between 1 and %d", maxPageSize)
+		}
+	}
+	if offsetStr := r.URL.Query().Get("offset"); offsetStr != "" {
+		offset, err = strconv.Atoi(offsetStr)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("offset must be 0 or more")
+		}
+		// the database still reads every row it skips, so deep pages get
+		// slower and slower
+		if offset > maxOffset {
+			return 0, 0, fmt.Errorf("offset must be at most %d, narrow the query down instead of paging this deep", maxOffset)
+		}
+	}
+	return limit, offset, nil
+}
+
+// handleListDiscordUsers pages through the users who've logged in, filtered
+// by ?q= on their global name
+func (s *ApiServer) handleListDiscordUsers(w http.ResponseWriter, r *http.Request) error {
+	limit, offset, err := parsePagination(r, s.config.MaxPageOffset)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	users, err := s.store.ListDiscordUsers(r.Context(), r.URL.Query().Get("q"), limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, discordUserSummaries(users))
+}
+
+// handleListInactiveDiscordUsers pages through the users
+// DISCORD_INACTIVE_AFTER or more since their last sign in, which
+// handleDeactivateInactiveDiscordUsers would deactivate
+func (s *ApiServer) handleListInactiveDiscordUsers(w http.ResponseWriter, r *http.Request) error {
+	limit, offset, err := parsePagination(r, s.config.MaxPageOffset)
+	if err != nil {
+		return httpErrorf(http.StatusBadRequest, "%s", err.Error())
+	}
+
+	before := time.Now().Add(-s.config.DiscordInactiveAfter)
+	users, err := s.store.ListInactiveDiscordUsers(r.Context(), before, limit, offset)
+	if err != nil {
+		return err
+	}
+	return WriteJson(w, http.StatusOK, discordUserSummaries(users))
+}
+
+// handleDeactivateInactiveDiscordUsers signs out and deactivates the users
+// DISCORD_INACTIVE_AFTER or more since their last sign in. It's meant to be
+// run on a schedule. Nothing is deleted: signing in again reactivates them.
+func (s *ApiServer) handleDeactivateInactiveDiscordUsers(w http.ResponseWriter, r *http.Request) error {
+	before := time.Now().Add(-s.config.DiscordInactiveAfter)
+	deactivated, err := s.store.DeactivateInactiveDiscordUsers(r.Context(), before)
+	if err != nil {
+		return err
+	}
+	s.logger.InfoContext(r.Context(), "deactivated inactive discord users", "count", deactivated, "inactive_since", before)
+	return WriteJson(w, http.StatusOK, map[string]int64{"deactivated": deactivated})
+}
+
+func discordUserSummaries(users []*DiscordUser) []*DiscordUserSummary {
+	summaries := make([]*DiscordUserSummary, 0, len(users))
+	for _, user := range users {
+		summaries = append(summaries, &DiscordUserSummary{
+			Id:            user.Id,
+			GlobalName:    user.GlobalName,
+			LastSignIn:    user.LastSignIn,
+			DeactivatedAt: user.DeactivatedAt,
+		})
+	}
+	return summaries
+}
+
+// handleReconcile reports whether balances and the ledger agree. Unbalanced
+// books are logged as an error as well, so alerting can pick them up.
+// Sandbox accounts are left out unless ?includeSandbox=true.
+func (s *ApiServer) handleReconcile(w http.ResponseWriter, r *http.Request) error {
+	includeSandbox := r.URL.Query().Get("includeSandbox") == "true"
+	rec, err := s.store.Reconcile(r.Context(), includeSandbox)
+	if err != nil {
+		return err
+	}
+	if !rec.Balanced {
+		s.logger.ErrorContext(r.Context(), "ledger does not reconcile",
+			"total_balance", rec.TotalBalance, "ledger_total", rec.LedgerTotal,
+			"discrepancy", rec.Discrepancy, "mismatched_accounts", rec.MismatchedAccounts)
+	}
+	return WriteJson(w, http.StatusOK, rec)
+}
+
+// handleExportAccounts streams every account as NDJSON for admin tooling.
+// It's only ever offered behind withAdminAuth, since it dumps every account
+// and runs without the usual timeouts.
+func (s *ApiServer) handleExportAccounts(w http.ResponseWriter, r *http.Request) error {
+	s.streamAccountsNdjson(w, r)
+	return nil
+}
+
+// ndjsonFlushEvery is how many accounts get written between flushes
+const ndjsonFlushEvery = 100
+
+// streamAccountsNdjson writes every account as one json object per line.
+// Once the first line is out the status can't change anymore, so a failure
+// part way through just ends the stream early and gets logged.
+// It stops as soon as the client goes away.
+func (s *ApiServer) streamAccountsNdjson(w http.ResponseWriter, r *http.Request) {
+	// a full export can outlast WriteTimeout and RequestTimeout, which are
+	// meant for normal responses
+	http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	ctx := untimedContext(r)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	written := 0
+	err := s.store.StreamAccounts(ctx, func(account *Account) error {
+		if err := enc.Encode(account); err != nil {
+			return err
+		}
+		written++
+		if flusher != nil && written%ndjsonFlushEvery == 0 {
+			flusher.Flush()
+		}
+		return nil
+	})
+	if errors.Is(err, context.Canceled) {
+		s.logger.InfoContext(r.Context(), "client left during account stream", "written", written)
+	} else if err != nil {
+		s.logger.ErrorContext(r.Context(), "account stream ended early", "written", written, "err", err)
+	}
+	if flusher != nil {
+		flusher.Flush()
 	}
-	return nil
 }
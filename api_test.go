@@ -0,0 +1,1704 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"golang.org/x/oauth2"
+)
+
+// newTestServer is the server main would build, on store, with just the
+// settings config requires
+func newTestServer(t *testing.T, store Storage) *ApiServer {
+	t.Helper()
+	setRequiredConfig(t)
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewApiService(config, store, &oauth2.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	return s
+}
+
+// stubDiscord answers oauth token exchanges and user lookups in place of
+// discord, signing in as user
+type stubDiscord struct {
+	user string
+}
+
+func (d stubDiscord) RoundTrip(r *http.Request) (*http.Response, error) {
+	body := `{"access_token":"test-token","token_type":"Bearer","expires_in":3600}`
+	if strings.HasSuffix(r.URL.Path, "/users/@me") {
+		body = d.user
+	}
+	return &http.Response{
+		StatusCode: http.StatusOK,
+		Header:     http.Header{"Content-Type": {"application/json"}},
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    r,
+	}, nil
+}
+
+// signInWithDiscord runs a login through handleAuthCallback and returns
+// where it sent the browser
+func signInWithDiscord(t *testing.T, s *ApiServer, user string) string {
+	t.Helper()
+	stateRec := httptest.NewRecorder()
+	state, err := s.issueOAuthState(stateRec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?code=test-code&state="+state, nil)
+	for _, cookie := range stateRec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	ctx := context.WithValue(req.Context(), oauth2.HTTPClient, &http.Client{Transport: stubDiscord{user}})
+	rec := httptest.NewRecorder()
+	s.handleAuthCallback(rec, req.WithContext(ctx))
+
+	if rec.Code != http.StatusFound {
+		t.Fatalf("callback status %d, want 302: %s", rec.Code, rec.Body)
+	}
+	return rec.Header().Get("Location")
+}
+
+func TestAuthCallbackWelcomesFirstLogin(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.auth.Endpoint = oauth2.Endpoint{TokenURL: "https://discord.test/api/oauth2/token"}
+	user := `{"id":"80351110224678912","global_name":"Nelly"}`
+
+	if got, want := signInWithDiscord(t, s, user), s.config.WelcomePath+"?firstLogin=true"; got != want {
+		t.Errorf("first login went to %q, want %q", got, want)
+	}
+	if got := signInWithDiscord(t, s, user); got != "/" {
+		t.Errorf("returning login went to %q, want /", got)
+	}
+}
+
+func TestAuthCallbackDoesNotWaitForAvatar(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.auth.Endpoint = oauth2.Endpoint{TokenURL: "https://discord.test/api/oauth2/token"}
+
+	// a cdn that doesn't answer until the test is over
+	release := make(chan struct{})
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	t.Cleanup(cdn.Close)
+	t.Cleanup(func() { close(release) })
+	s.avatars.baseURL = cdn.URL
+
+	start := time.Now()
+	signInWithDiscord(t, s, `{"id":"80351110224678912","global_name":"Nelly","avatar":"abc"}`)
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("login took %s waiting on the avatar cdn", took)
+	}
+}
+
+func TestWelcomeViewBranchesOnFirstLogin(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	for path, want := range map[string]string{
+		"/view/welcome?firstLogin=true": "Welcome to Chorse",
+		"/view/welcome":                 "Welcome back",
+	} {
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if body := rec.Body.String(); !strings.Contains(body, want) {
+			t.Errorf("%s doesn't say %q:\n%s", path, want, body)
+		}
+	}
+}
+
+// newTestAccount opens an account in the server's store, returning it and a
+// token for it
+func newTestAccount(t *testing.T, s *ApiServer, firstName, lastName string) (*Account, string) {
+	t.Helper()
+	account := NewAccount(firstName, lastName)
+	account.Currency = "USD"
+	account, err := s.store.CreateAccount(context.Background(), account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.createJwt(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return account, token
+}
+
+// serve sends req through every route and middleware, as token if one is
+// given
+func serve(s *ApiServer, req *http.Request, token string) *httptest.ResponseRecorder {
+	if token != "" {
+		req.Header.Set("x-jwt-token", token)
+	}
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+	return rec
+}
+
+// wantApiError fails the test unless rec is a json error with status and code
+func wantApiError(t *testing.T, rec *httptest.ResponseRecorder, status int, code ErrorCode) {
+	t.Helper()
+	if rec.Code != status {
+		t.Fatalf("status %d, want %d: %s", rec.Code, status, rec.Body)
+	}
+	var apiErr ApiError
+	if err := json.Unmarshal(rec.Body.Bytes(), &apiErr); err != nil {
+		t.Fatalf("body isn't an ApiError: %v: %s", err, rec.Body)
+	}
+	if apiErr.Code != code || apiErr.Message == "" {
+		t.Fatalf("got %+v, want code %q with a message", apiErr, code)
+	}
+}
+
+func TestHandleGetAccount(t *testing.T) {
+	store := NewMockStore()
+	s := newTestServer(t, store)
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	other, _ := newTestAccount(t, s, "Charles", "Babbage")
+
+	t.Run("own account", func(t *testing.T) {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", account.Id), nil), token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+		}
+		var got Account
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != account.Id || got.FirstName != "Ada" {
+			t.Errorf("got %+v, want account %d", got, account.Id)
+		}
+	})
+	t.Run("someone else's", func(t *testing.T) {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", other.Id), nil), token)
+		wantApiError(t, rec, http.StatusForbidden, CodeNotYourAccount)
+	})
+	t.Run("no token", func(t *testing.T) {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", account.Id), nil), "")
+		wantApiError(t, rec, http.StatusUnauthorized, CodeMissingToken)
+	})
+	t.Run("gone", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		s.makeHttpHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return s.handleGetAccount(w, r, 999)
+		})(rec, httptest.NewRequest(http.MethodGet, "/account/999", nil))
+		wantApiError(t, rec, http.StatusNotFound, CodeAccountNotFound)
+	})
+	t.Run("store failure", func(t *testing.T) {
+		store.Errors["GetAccountById"] = errors.New("connection reset")
+		defer delete(store.Errors, "GetAccountById")
+		rec := httptest.NewRecorder()
+		s.makeHttpHandleFunc(func(w http.ResponseWriter, r *http.Request) error {
+			return s.handleGetAccount(w, r, account.Id)
+		})(rec, httptest.NewRequest(http.MethodGet, "/account/1", nil))
+		wantApiError(t, rec, http.StatusInternalServerError, CodeInternal)
+		if strings.Contains(rec.Body.String(), "connection reset") {
+			t.Error("internal error leaked to the client")
+		}
+	})
+}
+
+func TestHandleCreateAccount(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+		code   ErrorCode
+	}{
+		{"valid", `{"firstName":"Ada","lastName":"Lovelace","email":"ada@example.com"}`, http.StatusOK, ""},
+		{"with deposit", `{"firstName":"Ada","lastName":"Lovelace","initialDeposit":500}`, http.StatusOK, ""},
+		{"missing names", `{"firstName":"","lastName":""}`, http.StatusUnprocessableEntity, CodeValidationFailed},
+		{"bad email", `{"firstName":"Ada","lastName":"Lovelace","email":"not an address"}`, http.StatusUnprocessableEntity, CodeValidationFailed},
+		{"negative deposit", `{"firstName":"Ada","lastName":"Lovelace","initialDeposit":-5}`, http.StatusBadRequest, CodeInvalidRequest},
+		{"external id", `{"firstName":"Ada","lastName":"Lovelace","externalId":"imp-1"}`, http.StatusForbidden, CodeAdminRequired},
+		{"malformed", `{"firstName":`, http.StatusBadRequest, CodeInvalidRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := newTestServer(t, NewMockStore())
+			rec := serve(s, httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(test.body)), "")
+			if test.code != "" {
+				wantApiError(t, rec, test.status, test.code)
+				return
+			}
+			if rec.Code != test.status {
+				t.Fatalf("status %d, want %d: %s", rec.Code, test.status, rec.Body)
+			}
+			var created struct {
+				Id    int    `json:"id"`
+				Token string `json:"token"`
+			}
+			if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+				t.Fatal(err)
+			}
+			if created.Token == "" {
+				t.Error("no token for the new account")
+			}
+			stored, err := s.store.GetAccountById(context.Background(), created.Id)
+			if err != nil || stored == nil {
+				t.Fatalf("account %d wasn't stored: %v", created.Id, err)
+			}
+		})
+	}
+}
+
+func TestHandleCreateAccountStoreFailure(t *testing.T) {
+	store := NewMockStore()
+	store.Errors["CreateAccount"] = errors.New("disk full")
+	s := newTestServer(t, store)
+	rec := serve(s, httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName":"Ada","lastName":"Lovelace"}`)), "")
+	wantApiError(t, rec, http.StatusInternalServerError, CodeInternal)
+}
+
+func TestGetAccountFieldSelection(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+
+	rec := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d?fields=id,firstName", account.Id), nil), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var got map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got["firstName"] != "Ada" || got["id"] != float64(account.Id) {
+		t.Errorf("got %v, want just id and firstName", got)
+	}
+
+	rec = serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d?fields=id,password", account.Id), nil), token)
+	wantApiError(t, rec, http.StatusBadRequest, CodeInvalidRequest)
+}
+
+func TestStaticCanBeDisabled(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/static/styles.css", nil), "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("enabled: status %d, want 200", rec.Code)
+	}
+
+	s.config.StaticEnabled = false
+	rec = serve(s, httptest.NewRequest(http.MethodGet, "/static/styles.css", nil), "")
+	wantApiError(t, rec, s.config.DisabledStatus, CodeFeatureDisabled)
+}
+
+func TestDeniedAccessIsLoggedAsWarning(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	var logs bytes.Buffer
+	s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/interest", nil)
+	req.Header.Set("x-admin-token", "guessed-token-value")
+	serve(s, req, "")
+
+	var line map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &line); err != nil {
+		t.Fatalf("want one json log line: %v: %s", err, logs.String())
+	}
+	for key, want := range map[string]any{
+		"level":     "WARN",
+		"msg":       "authorization denied",
+		"decision":  "deny",
+		"principal": "anonymous",
+		"resource":  "POST /admin/interest",
+	} {
+		if line[key] != want {
+			t.Errorf("%s is %v, want %v", key, line[key], want)
+		}
+	}
+	if line["reason"] == "" || strings.Contains(logs.String(), "guessed-token-value") {
+		t.Errorf("want a reason and no token in %s", logs.String())
+	}
+}
+
+func TestNoDotfiles(t *testing.T) {
+	h := noDotfiles(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for path, want := range map[string]int{
+		"/.env":             http.StatusNotFound,
+		"/.git/config":      http.StatusNotFound,
+		"/css/.htaccess":    http.StatusNotFound,
+		"/styles.css":       http.StatusOK,
+		"/vendor.v2/app.js": http.StatusOK,
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+		if rec.Code != want {
+			t.Errorf("%s: status %d, want %d", path, rec.Code, want)
+		}
+	}
+
+	s := newTestServer(t, NewMockStore())
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, "/static/.gitkeep", nil), ""); rec.Code != http.StatusNotFound {
+		t.Errorf("/static/.gitkeep: status %d, want 404", rec.Code)
+	}
+}
+
+// transfer posts a transfer of amount from one account to another as token
+func transfer(s *ApiServer, token string, from, to int, amount Amount) *httptest.ResponseRecorder {
+	body := fmt.Sprintf(`{"fromAccount":%d,"toAccount":%d,"amount":%d}`, from, to, amount)
+	return serve(s, httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(body)), token)
+}
+
+func TestTransferFeeCountsTowardsFunds(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.TransferFee = FeePolicy{Flat: 50}
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+	if _, err := s.store.Deposit(context.Background(), from.Id, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// the amount alone is covered, but not with the fee on top
+	rec := transfer(s, token, from.Id, to.Id, 1000)
+	wantApiError(t, rec, http.StatusUnprocessableEntity, CodeInsufficientFunds)
+
+	rec = transfer(s, token, from.Id, to.Id, 950)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var resp TransferResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Balance != 0 || resp.Fee != 50 {
+		t.Errorf("got %+v, want a fee of 50 leaving 0", resp)
+	}
+}
+
+func TestValidateToken(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	validate := func(token string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodGet, "/token/validate", nil), token)
+	}
+
+	rec := validate(token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("valid token: status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	var got struct {
+		Valid  bool           `json:"valid"`
+		Claims map[string]any `json:"claims"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Valid || got.Claims["accountNumber"] != float64(account.Number) {
+		t.Errorf("got %+v, want valid claims for account %d", got, account.Number)
+	}
+	if _, ok := got.Claims["epoch"]; ok {
+		t.Error("claims include the epoch")
+	}
+
+	ttl := s.config.JwtTtl
+	s.config.JwtTtl = -time.Minute
+	expired, err := s.createJwt(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.JwtTtl = ttl
+	wantApiError(t, validate(expired), http.StatusUnauthorized, CodeTokenExpired)
+
+	if _, err := s.store.RevokeTokens(context.Background(), account.Id); err != nil {
+		t.Fatal(err)
+	}
+	wantApiError(t, validate(token), http.StatusUnauthorized, CodeTokenRevoked)
+}
+
+func TestTransferOnlyAllowsPost(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+
+	for _, method := range []string{http.MethodGet, http.MethodPut} {
+		rec := serve(s, httptest.NewRequest(method, "/transfer", nil), token)
+		if rec.Code != http.StatusMethodNotAllowed {
+			t.Errorf("%s: status %d, want 405", method, rec.Code)
+		}
+		if allow := rec.Header().Get("Allow"); allow != http.MethodPost {
+			t.Errorf("%s: Allow is %q, want POST", method, allow)
+		}
+	}
+
+	// nothing to send, but it got as far as checking the balance
+	rec := transfer(s, token, from.Id, to.Id, 10)
+	wantApiError(t, rec, http.StatusUnprocessableEntity, CodeInsufficientFunds)
+}
+
+func TestBusyTransfersDontBlockReads(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+	// every slot taken, as if that many transfers were in flight
+	for range cap(s.transferSlots) {
+		s.transferSlots <- struct{}{}
+	}
+
+	rec := transfer(s, token, from.Id, to.Id, 10)
+	wantApiError(t, rec, http.StatusServiceUnavailable, CodeBusy)
+	if rec.Header().Get("Retry-After") == "" {
+		t.Error("no Retry-After on a busy response")
+	}
+
+	rec = serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", from.Id), nil), token)
+	if rec.Code != http.StatusOK {
+		t.Errorf("read while transfers are busy: status %d, want 200", rec.Code)
+	}
+
+	<-s.transferSlots
+	rec = transfer(s, token, from.Id, to.Id, 10)
+	wantApiError(t, rec, http.StatusUnprocessableEntity, CodeInsufficientFunds)
+}
+
+func TestAuthUrlHasFreshState(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.auth.Endpoint = oauth2.Endpoint{AuthURL: "https://discord.test/oauth2/authorize"}
+
+	seen := map[string]bool{}
+	for range 3 {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, "/auth/url", nil), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+		}
+		var got struct {
+			Url string `json:"url"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		u, err := url.Parse(got.Url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		state := u.Query().Get("state")
+		if !strings.HasPrefix(got.Url, s.auth.Endpoint.AuthURL) || state == "" {
+			t.Fatalf("url %q isn't discord's with a state", got.Url)
+		}
+		if seen[state] {
+			t.Fatalf("state %q handed out twice", state)
+		}
+		seen[state] = true
+	}
+}
+
+// recordingNotifier keeps every event it's handed
+type recordingNotifier struct {
+	events []Event
+}
+
+func (n *recordingNotifier) Notify(ctx context.Context, event Event) error {
+	n.events = append(n.events, event)
+	return nil
+}
+
+func TestLowBalanceAlertsOnceUntilRecovered(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	notifier := &recordingNotifier{}
+	s.notifier = notifier
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	move := func(kind string, amount int) {
+		t.Helper()
+		path := fmt.Sprintf("/account/%d/%s", account.Id, kind)
+		body := strings.NewReader(fmt.Sprintf(`{"amount":%d}`, amount))
+		if rec := serve(s, httptest.NewRequest(http.MethodPost, path, body), token); rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", kind, rec.Code, rec.Body)
+		}
+	}
+	move("deposit", 1000)
+	threshold := int64(500)
+	if err := s.store.SetLowBalanceThreshold(context.Background(), account.Id, &threshold); err != nil {
+		t.Fatal(err)
+	}
+
+	move("withdraw", 600)
+	move("withdraw", 100)
+	if len(notifier.events) != 1 {
+		t.Fatalf("%d alerts after dropping low twice, want 1", len(notifier.events))
+	}
+	if e := notifier.events[0]; e.Kind != EventLowBalance || e.Balance != 400 || e.Threshold != 500 {
+		t.Errorf("got %+v, want a low balance alert at 400", e)
+	}
+
+	// back above the threshold, so the next drop alerts again
+	move("deposit", 500)
+	move("withdraw", 500)
+	if len(notifier.events) != 2 {
+		t.Errorf("%d alerts after recovering and dropping again, want 2", len(notifier.events))
+	}
+}
+
+func TestHomeAndStaticAssets(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/", nil), "")
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.Contains(body, "<title>Chorse</title>") || !strings.Contains(body, "<h1>Home</h1>") {
+		t.Errorf("/ isn't the home view in the layout: status %d:\n%s", rec.Code, body)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("HX-Request", "true")
+	rec = serve(s, req, "")
+	if body := rec.Body.String(); !strings.Contains(body, "<h1>Home</h1>") || strings.Contains(body, "<html") {
+		t.Errorf("htmx request for / should get the bare view:\n%s", body)
+	}
+
+	for path, contentType := range map[string]string{
+		"/static/styles.css":  "text/css",
+		"/static/htmx.min.js": "javascript",
+	} {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, path, nil), "")
+		if rec.Code != http.StatusOK || !strings.Contains(rec.Header().Get("Content-Type"), contentType) {
+			t.Errorf("%s: status %d, content type %q", path, rec.Code, rec.Header().Get("Content-Type"))
+		}
+	}
+}
+
+func TestValidateJwtAcceptsRotatedSecrets(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, _ := newTestAccount(t, s, "Ada", "Lovelace")
+	signWith := func(secret string) string {
+		t.Helper()
+		s.config.JwtSecrets = []string{secret}
+		token, err := s.createJwt(account)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	current := signWith("current-secret-that-is-long-enough")
+	previous := signWith("previous-secret-that-is-long-enough")
+	unknown := signWith("someone-elses-secret-that-is-long")
+
+	s.config.JwtSecrets = []string{"current-secret-that-is-long-enough", "previous-secret-that-is-long-enough"}
+	for name, token := range map[string]string{"current": current, "previous": previous} {
+		if _, err := s.validateJwt(token); err != nil {
+			t.Errorf("token signed with the %s secret: %v", name, err)
+		}
+	}
+	if _, err := s.validateJwt(unknown); err == nil {
+		t.Error("token signed with an unknown secret validated")
+	}
+}
+
+func TestRequestIdModes(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	request := func(id string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/healthz", nil)
+		if id != "" {
+			req.Header.Set("X-Request-Id", id)
+		}
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, mode := range []string{RequestIdGenerate, RequestIdStrict} {
+		s.config.RequestIdMode = mode
+		rec := request("edge-id-1")
+		if rec.Code != http.StatusOK || rec.Header().Get("X-Request-Id") != "edge-id-1" {
+			t.Errorf("%s with an id: status %d, id %q", mode, rec.Code, rec.Header().Get("X-Request-Id"))
+		}
+	}
+
+	s.config.RequestIdMode = RequestIdGenerate
+	rec := request("")
+	if rec.Code != http.StatusOK || rec.Header().Get("X-Request-Id") == "" {
+		t.Errorf("generate without an id: status %d, id %q", rec.Code, rec.Header().Get("X-Request-Id"))
+	}
+
+	s.config.RequestIdMode = RequestIdStrict
+	var logs bytes.Buffer
+	s.logger = slog.New(slog.NewJSONHandler(&logs, nil))
+	wantApiError(t, request(""), http.StatusBadRequest, CodeInvalidRequestId)
+	if !strings.Contains(logs.String(), "remote_addr") {
+		t.Errorf("rejection doesn't log the client: %s", logs.String())
+	}
+}
+
+func TestHttpServerTimeouts(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	if srv := s.httpServer(); srv.ReadHeaderTimeout <= 0 {
+		t.Errorf("ReadHeaderTimeout defaults to %v, want a limit", srv.ReadHeaderTimeout)
+	}
+
+	t.Setenv("READ_HEADER_TIMEOUT", "2s")
+	t.Setenv("READ_TIMEOUT", "10s")
+	t.Setenv("WRITE_TIMEOUT", "30s")
+	t.Setenv("IDLE_TIMEOUT", "90s")
+	srv := newTestServer(t, NewMockStore()).httpServer()
+	for name, got := range map[string]time.Duration{
+		"ReadHeaderTimeout": srv.ReadHeaderTimeout - 2*time.Second,
+		"ReadTimeout":       srv.ReadTimeout - 10*time.Second,
+		"WriteTimeout":      srv.WriteTimeout - 30*time.Second,
+		"IdleTimeout":       srv.IdleTimeout - 90*time.Second,
+	} {
+		if got != 0 {
+			t.Errorf("%s is off from the configured value by %v", name, got)
+		}
+	}
+}
+
+func TestHeadAccount(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+
+	rec := serve(s, httptest.NewRequest(http.MethodHead, fmt.Sprintf("/account/%d", account.Id), nil), token)
+	if rec.Code != http.StatusOK || rec.Body.Len() != 0 {
+		t.Errorf("existing account: status %d with %d bytes, want 200 and no body", rec.Code, rec.Body.Len())
+	}
+
+	// only the owner gets past withJwtAuth, so a missing account is asked
+	// about directly
+	rec = httptest.NewRecorder()
+	if err := s.handleAccountExists(rec, httptest.NewRequest(http.MethodHead, "/account/999", nil), 999); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusNotFound || rec.Body.Len() != 0 {
+		t.Errorf("missing account: status %d with %d bytes, want 404 and no body", rec.Code, rec.Body.Len())
+	}
+}
+
+func TestNoOpUpdateReturnsAccount(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	path := fmt.Sprintf("/account/%d", account.Id)
+
+	for method, body := range map[string]string{
+		http.MethodPatch: `{}`,
+		http.MethodPut:   `{"firstName":"Ada","lastName":"Lovelace"}`,
+	} {
+		rec := serve(s, httptest.NewRequest(method, path, strings.NewReader(body)), token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d, want 200: %s", method, rec.Code, rec.Body)
+		}
+		var got Account
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.Id != account.Id || got.FirstName != "Ada" || got.LastName != "Lovelace" || got.Number != account.Number {
+			t.Errorf("%s: got %+v, want the unchanged account", method, got)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodPatch, "/account/999", strings.NewReader(`{}`))
+	err := s.handleUpdateAccount(rec, req, 999)
+	var httpErr *HttpError
+	if !errors.As(err, &httpErr) || httpErr.Status != http.StatusNotFound {
+		t.Errorf("updating a missing account: err = %v, want a 404", err)
+	}
+}
+
+func TestValidateJwtRejectsExpiredToken(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, _ := newTestAccount(t, s, "Ada", "Lovelace")
+	s.config.JwtTtl = -time.Second
+	token, err := s.createJwt(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.validateJwt(token); !errors.Is(err, ErrTokenExpired) {
+		t.Errorf("err = %v, want ErrTokenExpired", err)
+	}
+}
+
+func TestJwtTtlIsConfigurable(t *testing.T) {
+	t.Setenv("JWT_TTL", "1h")
+	s := newTestServer(t, NewMockStore())
+	account, _ := newTestAccount(t, s, "Ada", "Lovelace")
+	tokenStr, err := s.createJwt(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.validateJwt(tokenStr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp, _ := token.Claims.(jwt.MapClaims)["exp"].(float64)
+	if left := time.Until(time.Unix(int64(exp), 0)); left < 59*time.Minute || left > time.Hour {
+		t.Errorf("token expires in %v, want an hour", left)
+	}
+}
+
+func TestAccountRoutesAreOwnerOnly(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	other, otherToken := newTestAccount(t, s, "Charles", "Babbage")
+	if _, err := s.store.Deposit(context.Background(), other.Id, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, route := range []struct{ method, path, body string }{
+		{http.MethodPatch, "/account/%d", `{"firstName":"Mallory"}`},
+		{http.MethodDelete, "/account/%d", ``},
+		{http.MethodPost, "/account/%d/withdraw", `{"amount":10}`},
+		{http.MethodGet, "/account/%d/transactions", ``},
+		{http.MethodGet, "/account/%d/statement", ``},
+	} {
+		req := func() *http.Request {
+			return httptest.NewRequest(route.method, fmt.Sprintf(route.path, other.Id), strings.NewReader(route.body))
+		}
+		rec := serve(s, req(), token)
+		wantApiError(t, rec, http.StatusForbidden, CodeNotYourAccount)
+		if route.method == http.MethodDelete {
+			continue
+		}
+		if rec := serve(s, req(), otherToken); rec.Code != http.StatusOK {
+			t.Errorf("owner %s %s: status %d, want 200: %s", route.method, route.path, rec.Code, rec.Body)
+		}
+	}
+
+	// the sender comes from the body rather than the path
+	wantApiError(t, transfer(s, token, other.Id, account.Id, 10), http.StatusForbidden, CodeNotYourAccount)
+	if rec := transfer(s, otherToken, other.Id, account.Id, 10); rec.Code != http.StatusOK {
+		t.Errorf("owner transfer: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestRevokeAllTokens(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	accountPath := fmt.Sprintf("/account/%d", account.Id)
+	revoke := func(token string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodPost, "/me/sessions/revoke-all", nil), token)
+	}
+
+	s.config.RevokeKeepsCurrent = false
+	if rec := revoke(token); rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	wantApiError(t, serve(s, httptest.NewRequest(http.MethodGet, accountPath, nil), token), http.StatusForbidden, CodeTokenRevoked)
+
+	// with a fresh token, this time keeping the current device signed in
+	account, err := s.store.GetAccountById(context.Background(), account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err = s.createJwt(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.config.RevokeKeepsCurrent = true
+	rec := revoke(token)
+	var got struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || got.Token == "" {
+		t.Fatalf("no replacement token: %v: %s", err, rec.Body)
+	}
+	wantApiError(t, serve(s, httptest.NewRequest(http.MethodGet, accountPath, nil), token), http.StatusForbidden, CodeTokenRevoked)
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, accountPath, nil), got.Token); rec.Code != http.StatusOK {
+		t.Errorf("replacement token: status %d, want 200", rec.Code)
+	}
+}
+
+func TestCreateAccountNormalizesNames(t *testing.T) {
+	for normalize, want := range map[bool]string{true: "John Paul", false: "  John   Paul "} {
+		s := newTestServer(t, NewMockStore())
+		s.config.NormalizeNames = normalize
+		body := strings.NewReader(`{"firstName":"  John   Paul ","lastName":"Jones"}`)
+		rec := serve(s, httptest.NewRequest(http.MethodPost, "/account", body), "")
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		var got Account
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.FirstName != want {
+			t.Errorf("normalize %v: first name %q, want %q", normalize, got.FirstName, want)
+		}
+	}
+}
+
+func TestMakeHttpHandleFuncMapsErrors(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	tests := []struct {
+		name    string
+		err     error
+		status  int
+		code    ErrorCode
+		message string
+	}{
+		{"http error", httpErrorf(http.StatusBadRequest, "bad id %d", 7), http.StatusBadRequest, CodeInvalidRequest, "bad id 7"},
+		{"coded error", codedErrorf(http.StatusConflict, CodeVersionConflict, "stale"), http.StatusConflict, CodeVersionConflict, "stale"},
+		{"wrapped", fmt.Errorf("loading: %w", httpErrorf(http.StatusNotFound, "nope")), http.StatusNotFound, CodeNotFound, "nope"},
+		{"validation", &ValidationError{Fields: map[string]string{"email": "invalid"}}, http.StatusUnprocessableEntity, CodeValidationFailed, "invalid request"},
+		{"anything else", errors.New("disk on fire"), http.StatusInternalServerError, CodeInternal, "internal server error"},
+	}
+	for _, test := range tests {
+		rec := httptest.NewRecorder()
+		s.makeHttpHandleFunc(func(http.ResponseWriter, *http.Request) error {
+			return test.err
+		})(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		if rec.Code != test.status {
+			t.Errorf("%s: status %d, want %d", test.name, rec.Code, test.status)
+		}
+		if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "application/json") {
+			t.Errorf("%s: content type %q", test.name, ct)
+		}
+		var got struct {
+			ApiError
+			Fields map[string]string `json:"fields"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+			t.Fatalf("%s: %v: %s", test.name, err, rec.Body)
+		}
+		if got.Code != test.code || got.Message != test.message {
+			t.Errorf("%s: got %q %q, want %q %q", test.name, got.Code, got.Message, test.code, test.message)
+		}
+		if test.code == CodeValidationFailed && got.Fields["email"] != "invalid" {
+			t.Errorf("%s: fields are %v", test.name, got.Fields)
+		}
+	}
+}
+
+func TestDisabledStatusIsConfigurable(t *testing.T) {
+	for value, want := range map[string]int{"": http.StatusNotImplemented, "403": http.StatusForbidden} {
+		t.Setenv("DISABLED_STATUS", value)
+		s := newTestServer(t, NewMockStore())
+		s.config.StaticEnabled = false
+		rec := serve(s, httptest.NewRequest(http.MethodGet, "/static/styles.css", nil), "")
+		wantApiError(t, rec, want, CodeFeatureDisabled)
+		if !strings.Contains(rec.Body.String(), "static file serving is disabled") {
+			t.Errorf("DISABLED_STATUS=%q: message doesn't name the feature: %s", value, rec.Body)
+		}
+	}
+
+	t.Setenv("DISABLED_STATUS", "404")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("DISABLED_STATUS=404 was accepted")
+	}
+}
+
+func TestExportAccountsAsNdjson(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	want := map[int]bool{}
+	for _, name := range []string{"Ada", "Charles", "Grace"} {
+		account, _ := newTestAccount(t, s, name, "Test")
+		want[account.Id] = true
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/admin/accounts/export", nil)
+	req.Header.Set("x-admin-token", s.config.AdminToken)
+	rec := serve(s, req, "")
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "application/x-ndjson" {
+		t.Fatalf("status %d, content type %q", rec.Code, rec.Header().Get("Content-Type"))
+	}
+
+	lines := strings.Split(strings.TrimSuffix(rec.Body.String(), "\n"), "\n")
+	if len(lines) != len(want) {
+		t.Fatalf("%d lines, want %d:\n%s", len(lines), len(want), rec.Body)
+	}
+	for _, line := range lines {
+		var account Account
+		if err := json.Unmarshal([]byte(line), &account); err != nil {
+			t.Fatalf("line isn't an account: %v: %s", err, line)
+		}
+		if !want[account.Id] {
+			t.Errorf("unexpected or repeated account %d", account.Id)
+		}
+		delete(want, account.Id)
+	}
+}
+
+func TestCreateAccountChecksNameLength(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.NameLength = NameLengthPolicy{Min: 2, Max: 5}
+	for body, status := range map[string]int{
+		`{"firstName":"Al","lastName":"Smith"}`:  http.StatusOK,
+		`{"firstName":"A","lastName":"Smith"}`:   http.StatusUnprocessableEntity,
+		`{"firstName":"Al","lastName":"Smithe"}`: http.StatusUnprocessableEntity,
+	} {
+		rec := serve(s, httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(body)), "")
+		if rec.Code != status {
+			t.Errorf("%s: status %d, want %d: %s", body, rec.Code, status, rec.Body)
+		}
+	}
+}
+
+func TestParsePagination(t *testing.T) {
+	for query, want := range map[string]string{
+		"":                    "50 0",
+		"?limit=10&offset=20": "10 20",
+		"?offset=1000":        "50 1000",
+		"?offset=1001":        "error",
+		"?offset=-1":          "error",
+		"?limit=0":            "error",
+		"?limit=201":          "error",
+	} {
+		limit, offset, err := parsePagination(httptest.NewRequest(http.MethodGet, "/accounts"+query, nil), 1000)
+		got := fmt.Sprintf("%d %d", limit, offset)
+		if err != nil {
+			got = "error"
+		}
+		if got != want {
+			t.Errorf("%q: got %s, want %s", query, got, want)
+		}
+	}
+}
+
+func TestOffsetOverCapIsRejected(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.MaxPageOffset = 100
+	req := httptest.NewRequest(http.MethodGet, "/admin/discord-users?offset=101", nil)
+	req.Header.Set("x-admin-token", s.config.AdminToken)
+	rec := serve(s, req, "")
+	wantApiError(t, rec, http.StatusBadRequest, CodeInvalidRequest)
+	if !strings.Contains(rec.Body.String(), "at most 100") {
+		t.Errorf("error doesn't give the cap: %s", rec.Body)
+	}
+}
+
+func TestCreateAccountReturnsUsableToken(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	rec := serve(s, httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName":"Ada","lastName":"Lovelace"}`)), "")
+	var created struct {
+		Id     int    `json:"id"`
+		Number int64  `json:"number"`
+		Token  string `json:"token"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := s.validateJwt(created.Token)
+	if err != nil {
+		t.Fatalf("token doesn't validate: %v", err)
+	}
+	if number := token.Claims.(jwt.MapClaims)["accountNumber"]; number != float64(created.Number) {
+		t.Errorf("token is for account number %v, want %d", number, created.Number)
+	}
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", created.Id), nil), created.Token); rec.Code != http.StatusOK {
+		t.Errorf("token doesn't open the new account: status %d", rec.Code)
+	}
+}
+
+// stuckStore is a store whose account reads hang until their context ends,
+// like a database that's stopped answering
+type stuckStore struct {
+	*MockStore
+}
+
+func (s stuckStore) GetAccountById(ctx context.Context, id int) (*Account, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func TestStuckStoreCallTimesOut(t *testing.T) {
+	s := newTestServer(t, stuckStore{NewMockStore()})
+	s.config.RequestTimeout = 50 * time.Millisecond
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", account.Id), nil)
+	req.Header.Set("x-jwt-token", token)
+	rec := httptest.NewRecorder()
+	start := time.Now()
+	s.handler().ServeHTTP(rec, req)
+
+	if took := time.Since(start); took > time.Second {
+		t.Errorf("request took %v with a 50ms timeout", took)
+	}
+	wantApiError(t, rec, http.StatusInternalServerError, CodeInternal)
+}
+
+func TestCors(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.CorsOrigins = []string{"https://app.chorse.test"}
+	request := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/healthz", nil)
+		req.Header.Set("Origin", origin)
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodGet)
+		}
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := request(http.MethodOptions, "https://app.chorse.test", true)
+	if rec.Code != http.StatusNoContent {
+		t.Fatalf("allowed preflight: status %d, want 204", rec.Code)
+	}
+	for header, want := range map[string]string{
+		"Access-Control-Allow-Origin":      "https://app.chorse.test",
+		"Access-Control-Allow-Credentials": "true",
+	} {
+		if got := rec.Header().Get(header); got != want {
+			t.Errorf("%s is %q, want %q", header, got, want)
+		}
+	}
+	if !slices.Contains(rec.Header().Values("Vary"), "Origin") {
+		t.Errorf("response doesn't vary by origin: %v", rec.Header().Values("Vary"))
+	}
+	if !strings.Contains(rec.Header().Get("Access-Control-Allow-Headers"), "Hx-Request") {
+		t.Errorf("htmx headers aren't allowed: %q", rec.Header().Get("Access-Control-Allow-Headers"))
+	}
+
+	wantApiError(t, request(http.MethodOptions, "https://evil.test", true), http.StatusForbidden, CodeOriginNotAllowed)
+
+	// served, but without the headers that would let the page read it
+	rec = request(http.MethodGet, "https://evil.test", false)
+	if rec.Code != http.StatusOK || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("disallowed origin: status %d, allow origin %q", rec.Code, rec.Header().Get("Access-Control-Allow-Origin"))
+	}
+}
+
+func TestTlsPolicy(t *testing.T) {
+	for value, want := range map[string]uint16{"": tls.VersionTLS12, "1.3": tls.VersionTLS13} {
+		t.Setenv("TLS_MIN_VERSION", value)
+		if got := newTestServer(t, NewMockStore()).tlsConfig().MinVersion; got != want {
+			t.Errorf("TLS_MIN_VERSION=%q: min version %x, want %x", value, got, want)
+		}
+	}
+	t.Setenv("TLS_MIN_VERSION", "1.1")
+	if _, err := LoadConfig(); err == nil {
+		t.Error("TLS_MIN_VERSION=1.1 was accepted")
+	}
+
+	t.Setenv("TLS_MIN_VERSION", "1.2")
+	s := newTestServer(t, NewMockStore())
+	server := httptest.NewUnstartedServer(s.handler())
+	server.TLS = s.tlsConfig()
+	server.StartTLS()
+	defer server.Close()
+
+	for _, test := range []struct {
+		name     string
+		min, max uint16
+		suites   []uint16
+		succeed  bool
+	}{
+		{"tls 1.3", tls.VersionTLS13, 0, nil, true},
+		{"tls 1.2", 0, tls.VersionTLS12, nil, true},
+		{"tls 1.1", tls.VersionTLS10, tls.VersionTLS11, nil, false},
+		{"cbc suite", 0, tls.VersionTLS12, []uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA}, false},
+	} {
+		client := server.Client()
+		transport := client.Transport.(*http.Transport)
+		transport.TLSClientConfig.MinVersion = test.min
+		transport.TLSClientConfig.MaxVersion = test.max
+		transport.TLSClientConfig.CipherSuites = test.suites
+		res, err := client.Get(server.URL + "/healthz")
+		if err == nil {
+			res.Body.Close()
+		}
+		if (err == nil) != test.succeed {
+			t.Errorf("%s: err = %v, want success %v", test.name, err, test.succeed)
+		}
+		transport.CloseIdleConnections()
+	}
+}
+
+func TestAdminCreateAccount(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	_, userToken := newTestAccount(t, s, "Ada", "Lovelace")
+	create := func(adminToken, userToken string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/admin/accounts", strings.NewReader(`{"firstName":"Grace","lastName":"Hopper"}`))
+		if adminToken != "" {
+			req.Header.Set("x-admin-token", adminToken)
+		}
+		return serve(s, req, userToken)
+	}
+
+	wantApiError(t, create("", ""), http.StatusForbidden, CodeAdminRequired)
+	wantApiError(t, create("", userToken), http.StatusForbidden, CodeAdminRequired)
+	wantApiError(t, create("guessed-token-value", ""), http.StatusForbidden, CodeAdminRequired)
+
+	rec := create(s.config.AdminToken, "")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	var created map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil {
+		t.Fatal(err)
+	}
+	if created["firstName"] != "Grace" || created["lastName"] != "Hopper" {
+		t.Errorf("got %s", rec.Body)
+	}
+	if _, ok := created["token"]; ok {
+		t.Error("admin was handed the owner's token")
+	}
+}
+
+func TestTransferWhitelist(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	listed, _ := newTestAccount(t, s, "Charles", "Babbage")
+	unlisted, _ := newTestAccount(t, s, "Grace", "Hopper")
+	if _, err := s.store.Deposit(context.Background(), from.Id, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	whitelist := func(method, body string) *httptest.ResponseRecorder {
+		t.Helper()
+		rec := serve(s, httptest.NewRequest(method, fmt.Sprintf("/account/%d/whitelist", from.Id), strings.NewReader(body)), token)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s whitelist: status %d: %s", method, rec.Code, rec.Body)
+		}
+		return rec
+	}
+
+	// entries don't matter until it's switched on
+	whitelist(http.MethodPost, fmt.Sprintf(`{"number":%d}`, listed.Number))
+	if rec := transfer(s, token, from.Id, unlisted.Id, 100); rec.Code != http.StatusOK {
+		t.Fatalf("whitelist off: status %d: %s", rec.Code, rec.Body)
+	}
+
+	rec := whitelist(http.MethodPut, `{"enabled":true}`)
+	var got TransferWhitelist
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if !got.Enabled || !slices.Equal(got.Numbers, []int64{listed.Number}) {
+		t.Errorf("whitelist is %+v", got)
+	}
+	if rec := transfer(s, token, from.Id, listed.Id, 100); rec.Code != http.StatusOK {
+		t.Errorf("to listed account: status %d: %s", rec.Code, rec.Body)
+	}
+	wantApiError(t, transfer(s, token, from.Id, unlisted.Id, 100), http.StatusForbidden, CodeNotWhitelisted)
+
+	// adding a number that isn't an account is refused
+	rec = serve(s, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/account/%d/whitelist", from.Id), strings.NewReader(`{"number":1}`)), token)
+	wantApiError(t, rec, http.StatusNotFound, CodeAccountNotFound)
+
+	rec = serve(s, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/account/%d/whitelist/%d", from.Id, listed.Number), nil), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("remove: status %d: %s", rec.Code, rec.Body)
+	}
+	wantApiError(t, transfer(s, token, from.Id, listed.Id, 100), http.StatusForbidden, CodeNotWhitelisted)
+}
+
+// clashingStore turns away the first clashes accounts it's asked to create
+// as having a taken number, noting each number tried
+type clashingStore struct {
+	*MockStore
+	clashes int
+	tried   []int64
+}
+
+func (s *clashingStore) CreateAccount(ctx context.Context, account *Account) (*Account, error) {
+	s.tried = append(s.tried, account.Number)
+	if len(s.tried) <= s.clashes {
+		return nil, &DuplicateError{Field: "number"}
+	}
+	return s.MockStore.CreateAccount(ctx, account)
+}
+
+func TestCreateAccountRetriesTakenNumbers(t *testing.T) {
+	create := func(s *ApiServer) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName":"Ada","lastName":"Lovelace"}`)), "")
+	}
+
+	store := &clashingStore{MockStore: NewMockStore(), clashes: 2}
+	rec := create(newTestServer(t, store))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if len(store.tried) != 3 {
+		t.Fatalf("tried %d numbers, want 3", len(store.tried))
+	}
+	slices.Sort(store.tried)
+	if len(slices.Compact(store.tried)) != 3 {
+		t.Errorf("the same number was tried twice: %v", store.tried)
+	}
+
+	store = &clashingStore{MockStore: NewMockStore(), clashes: accountNumberAttempts}
+	wantApiError(t, create(newTestServer(t, store)), http.StatusConflict, CodeDuplicate)
+	if len(store.tried) != accountNumberAttempts {
+		t.Errorf("tried %d numbers, want %d", len(store.tried), accountNumberAttempts)
+	}
+}
+
+func TestSoftDeletedAccountsAreHidden(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	deleted, token := newTestAccount(t, s, "Ada", "Lovelace")
+	kept, _ := newTestAccount(t, s, "Ada", "Byron")
+
+	rec := serve(s, httptest.NewRequest(http.MethodDelete, fmt.Sprintf("/account/%d", deleted.Id), nil), token)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("delete: status %d: %s", rec.Code, rec.Body)
+	}
+
+	for _, path := range []string{"/account", "/account?q=Ada"} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("x-admin-token", s.config.AdminToken)
+		rec := serve(s, req, "")
+		var page struct {
+			Accounts []Account `json:"accounts"`
+			Total    int64     `json:"total"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil {
+			t.Fatalf("%s: %v: %s", path, err, rec.Body)
+		}
+		if page.Total != 1 || len(page.Accounts) != 1 || page.Accounts[0].Id != kept.Id {
+			t.Errorf("%s: got %s, want just account %d", path, rec.Body, kept.Id)
+		}
+	}
+
+	if account, err := s.store.GetAccountById(context.Background(), deleted.Id); err != nil || account != nil {
+		t.Errorf("deleted account still found: %+v, %v", account, err)
+	}
+
+	// nor can it be changed or read through the rest of the store
+	ctx := context.Background()
+	if _, err := s.store.RevokeTokens(ctx, deleted.Id); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("revoking tokens: err = %v, want ErrAccountNotFound", err)
+	}
+	threshold := int64(100)
+	if err := s.store.SetLowBalanceThreshold(ctx, deleted.Id, &threshold); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("setting a threshold: err = %v, want ErrAccountNotFound", err)
+	}
+	if _, err := s.store.GetStatement(ctx, deleted.Id, time.Time{}, time.Now()); !errors.Is(err, ErrAccountNotFound) {
+		t.Errorf("reading a statement: err = %v, want ErrAccountNotFound", err)
+	}
+}
+
+func TestCreateAccountCurrency(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.DefaultCurrency = "EUR"
+	create := func(body string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(body)), "")
+	}
+
+	for body, want := range map[string]string{
+		`{"firstName":"Ada","lastName":"Lovelace"}`:                  "EUR",
+		`{"firstName":"Ada","lastName":"Lovelace","currency":"gbp"}`: "GBP",
+	} {
+		rec := create(body)
+		var account Account
+		if err := json.Unmarshal(rec.Body.Bytes(), &account); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", body, rec.Code, rec.Body)
+		}
+		if account.Currency != want {
+			t.Errorf("%s: currency %s, want %s", body, account.Currency, want)
+		}
+	}
+	wantApiError(t, create(`{"firstName":"Ada","lastName":"Lovelace","currency":"XYZ"}`), http.StatusUnprocessableEntity, CodeValidationFailed)
+}
+
+func TestBalanceSnapshots(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	if _, err := s.store.Deposit(context.Background(), account.Id, 500, nil); err != nil {
+		t.Fatal(err)
+	}
+	snapshot := func(query string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d/snapshot%s", account.Id, query), nil), token)
+	}
+	wantApiError(t, snapshot(""), http.StatusNotFound, CodeNotFound)
+
+	req := httptest.NewRequest(http.MethodPost, "/admin/snapshots", nil)
+	req.Header.Set("x-admin-token", s.config.AdminToken)
+	rec := serve(s, req, "")
+	var run SnapshotRun
+	if err := json.Unmarshal(rec.Body.Bytes(), &run); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("take snapshot: status %d: %s", rec.Code, rec.Body)
+	}
+	if run.Accounts != 1 {
+		t.Errorf("snapshot covered %d accounts, want 1", run.Accounts)
+	}
+
+	// the snapshot keeps the balance it was taken at
+	if _, err := s.store.Deposit(context.Background(), account.Id, 250, nil); err != nil {
+		t.Fatal(err)
+	}
+	rec = snapshot("")
+	var got BalanceSnapshot
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got.AccountId != account.Id || got.Balance != 500 || got.Currency != account.Currency {
+		t.Errorf("got %+v, want a balance of 500", got)
+	}
+
+	before := url.QueryEscape(run.TakenAt.Add(-time.Minute).Format(time.RFC3339))
+	wantApiError(t, snapshot("?at="+before), http.StatusNotFound, CodeNotFound)
+	wantApiError(t, snapshot("?at=yesterday"), http.StatusBadRequest, CodeInvalidRequest)
+}
+
+func TestUnknownRoutesAndMethods(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+
+	for _, path := range []string{"/account/bogus/extra", "/nope", "/admin"} {
+		rec := serve(s, httptest.NewRequest(http.MethodGet, path, nil), token)
+		wantApiError(t, rec, http.StatusNotFound, CodeNotFound)
+		if !strings.Contains(rec.Body.String(), path) {
+			t.Errorf("%s: the error doesn't name the path: %s", path, rec.Body)
+		}
+	}
+
+	for _, test := range []struct{ method, path, allow string }{
+		{http.MethodPost, fmt.Sprintf("/account/%d", account.Id), "GET, HEAD, PUT, PATCH, DELETE"},
+		{http.MethodDelete, "/account", "GET, POST"},
+		{http.MethodPost, "/", "GET, HEAD"},
+		{http.MethodPut, "/static/styles.css", "GET, HEAD"},
+	} {
+		rec := serve(s, httptest.NewRequest(test.method, test.path, nil), token)
+		wantApiError(t, rec, http.StatusMethodNotAllowed, CodeMethodNotAllowed)
+		if allow := rec.Header().Get("Allow"); allow != test.allow {
+			t.Errorf("%s %s: Allow is %q, want %q", test.method, test.path, allow, test.allow)
+		}
+	}
+}
+
+func TestRequestToken(t *testing.T) {
+	for _, test := range []struct {
+		name          string
+		authorization string
+		legacy        string
+		want          string
+	}{
+		{"bearer", "Bearer abc", "", "abc"},
+		{"bearer any case", "bearer abc", "", "abc"},
+		{"bearer wins", "Bearer abc", "def", "abc"},
+		{"legacy header", "", "def", "def"},
+		{"other scheme", "Basic dXNlcjpwYXNz", "def", "def"},
+		{"empty bearer", "Bearer  ", "def", "def"},
+		{"none", "", "", ""},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if test.authorization != "" {
+			req.Header.Set("Authorization", test.authorization)
+		}
+		if test.legacy != "" {
+			req.Header.Set("x-jwt-token", test.legacy)
+		}
+		if got := requestToken(req); got != test.want {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.want)
+		}
+	}
+}
+
+func TestBearerTokenAuth(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	get := func(header, value string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", account.Id), nil)
+		if header != "" {
+			req.Header.Set(header, value)
+		}
+		return serve(s, req, "")
+	}
+
+	for header, value := range map[string]string{"Authorization": "Bearer " + token, "x-jwt-token": token} {
+		if rec := get(header, value); rec.Code != http.StatusOK {
+			t.Errorf("%s: status %d: %s", header, rec.Code, rec.Body)
+		}
+	}
+	rec := get("", "")
+	wantApiError(t, rec, http.StatusUnauthorized, CodeMissingToken)
+	if rec.Header().Get("WWW-Authenticate") != "Bearer" {
+		t.Errorf("WWW-Authenticate is %q, want Bearer", rec.Header().Get("WWW-Authenticate"))
+	}
+	wantApiError(t, get("Authorization", "Bearer "+token+"x"), http.StatusForbidden, CodeInvalidToken)
+}
+
+func TestGetAccountByNumber(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	other, _ := newTestAccount(t, s, "Charles", "Babbage")
+	lookup := func(number string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodGet, "/account/by-number?number="+number, nil), token)
+	}
+
+	rec := lookup(fmt.Sprint(account.Number))
+	var got Account
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if got.Id != account.Id {
+		t.Errorf("got account %d, want %d", got.Id, account.Id)
+	}
+	wantApiError(t, lookup(fmt.Sprint(other.Number)), http.StatusForbidden, CodeNotYourAccount)
+	wantApiError(t, lookup("twelve"), http.StatusBadRequest, CodeInvalidRequest)
+
+	if found, err := s.store.GetAccountByNumber(context.Background(), 1); err != nil || found != nil {
+		t.Errorf("unknown number: got %+v, %v, want nil, nil", found, err)
+	}
+}
+
+func TestGetAccountsByNumbers(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	first, _ := newTestAccount(t, s, "Ada", "Lovelace")
+	second, _ := newTestAccount(t, s, "Charles", "Babbage")
+
+	found, err := s.store.GetAccountsByNumbers(context.Background(), []int64{first.Number, 1, second.Number, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 {
+		t.Fatalf("got %d accounts, want 2: %v", len(found), found)
+	}
+	for _, account := range []*Account{first, second} {
+		if got := found[account.Number]; got == nil || got.Id != account.Id {
+			t.Errorf("number %d: got %+v, want account %d", account.Number, got, account.Id)
+		}
+	}
+}
+
+func TestImportByExternalIdIsIdempotent(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	create := func(body string, admin bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(body))
+		if admin {
+			req.Header.Set("x-admin-token", s.config.AdminToken)
+		}
+		return serve(s, req, "")
+	}
+	ids := func(rec *httptest.ResponseRecorder) int {
+		t.Helper()
+		var account Account
+		if err := json.Unmarshal(rec.Body.Bytes(), &account); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return account.Id
+	}
+
+	first := ids(create(`{"firstName":"Ada","lastName":"Lovelace","externalId":"imp-1"}`, true))
+	// a re-run of the import, even with other details, gets the same account
+	if again := ids(create(`{"firstName":"Ada","lastName":"Byron","externalId":"imp-1"}`, true)); again != first {
+		t.Errorf("re-import made account %d, want %d back", again, first)
+	}
+	if other := ids(create(`{"firstName":"Ada","lastName":"Lovelace","externalId":"imp-2"}`, true)); other == first {
+		t.Error("a different external id got the same account")
+	}
+	if _, total, _ := s.store.GetAccounts(context.Background(), 10, 0); total != 2 {
+		t.Errorf("%d accounts, want 2", total)
+	}
+
+	wantApiError(t, create(`{"firstName":"Ada","lastName":"Lovelace","externalId":"imp-1"}`, false), http.StatusForbidden, CodeAdminRequired)
+}
+
+func TestAccountTimesMatchAcrossResponses(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+
+	one := serve(s, httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", account.Id), nil), token)
+	var single map[string]any
+	if err := json.Unmarshal(one.Body.Bytes(), &single); err != nil {
+		t.Fatalf("%v: %s", err, one.Body)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/account", nil)
+	req.Header.Set("x-admin-token", s.config.AdminToken)
+	all := serve(s, req, "")
+	var page struct {
+		Accounts []map[string]any `json:"accounts"`
+	}
+	if err := json.Unmarshal(all.Body.Bytes(), &page); err != nil || len(page.Accounts) != 1 {
+		t.Fatalf("%v: %s", err, all.Body)
+	}
+
+	want := account.CreatedAt.UTC().Format(time.RFC3339)
+	if single["createdAt"] != want || page.Accounts[0]["createdAt"] != want {
+		t.Errorf("createdAt is %v by id and %v listed, want %s", single["createdAt"], page.Accounts[0]["createdAt"], want)
+	}
+}
+
+func TestTransferAmountLimit(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.MaxTransferAmount = 1000
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+	if _, err := s.store.Deposit(context.Background(), from.Id, 5000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	if rec := transfer(s, token, from.Id, to.Id, 1000); rec.Code != http.StatusOK {
+		t.Fatalf("at the limit: status %d: %s", rec.Code, rec.Body)
+	}
+	wantApiError(t, transfer(s, token, from.Id, to.Id, 1001), http.StatusUnprocessableEntity, CodeValidationFailed)
+	for _, amount := range []string{`9223372036854775808`, `1e30`, `"99999999999999999999"`} {
+		body := fmt.Sprintf(`{"fromAccount":%d,"toAccount":%d,"amount":%s}`, from.Id, to.Id, amount)
+		rec := serve(s, httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(body)), token)
+		wantApiError(t, rec, http.StatusUnprocessableEntity, CodeValidationFailed)
+		if !strings.Contains(rec.Body.String(), "at most 1000") {
+			t.Errorf("%s: %s", amount, rec.Body)
+		}
+	}
+
+	got, err := s.store.GetAccountById(context.Background(), from.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Balance != 4000 {
+		t.Errorf("balance %d, want only the transfer at the limit taken", got.Balance)
+	}
+}
+
+func TestDecodeJSON(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.MaxBodyBytes = 64
+	decode := func(body string) error {
+		var v CreateAccountRequest
+		return s.decodeJSON(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(body)), &v)
+	}
+
+	if err := decode(`{"firstName":"Ada","lastName":"Lovelace"}`); err != nil {
+		t.Fatalf("valid body: %v", err)
+	}
+	for name, test := range map[string]struct{ body, message string }{
+		"over the limit": {`{"firstName":"` + strings.Repeat("a", 64) + `"}`, "over the 64 byte limit"},
+		"unknown field":  {`{"firstName":"Ada","frstName":"Ada"}`, `unknown field "frstName"`},
+		"empty":          {``, "request body is empty"},
+		"two values":     {`{"firstName":"Ada"} {}`, "single json value"},
+		"not json":       {`firstName=Ada`, "invalid request body"},
+	} {
+		var httpErr *HttpError
+		if err := decode(test.body); !errors.As(err, &httpErr) || httpErr.Status != http.StatusBadRequest || !strings.Contains(httpErr.Message, test.message) {
+			t.Errorf("%s: err = %v, want a 400 saying %q", name, err, test.message)
+		}
+	}
+}
+
+func TestCreateSandboxAccount(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	create := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName":"Ada","lastName":"Lovelace"}`))
+		req.Header.Set("X-Sandbox", "true")
+		return serve(s, req, "")
+	}
+
+	s.config.SandboxAccounts = false
+	wantApiError(t, create(), s.config.DisabledStatus, CodeFeatureDisabled)
+
+	s.config.SandboxAccounts = true
+	rec := create()
+	var account Account
+	if err := json.Unmarshal(rec.Body.Bytes(), &account); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if !account.Sandbox {
+		t.Error("account isn't marked as a sandbox one")
+	}
+}
+
+func TestDeactivateInactiveDiscordUsersRoute(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	if _, err := s.store.UpsertDiscordUser(context.Background(), &DiscordUser{Id: "80351110224678912", GlobalName: "Nelly"}); err != nil {
+		t.Fatal(err)
+	}
+	admin := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.Header.Set("x-admin-token", s.config.AdminToken)
+		return serve(s, req, "")
+	}
+	inactive := func() []DiscordUserSummary {
+		t.Helper()
+		rec := admin(http.MethodGet, "/admin/discord-users/inactive")
+		var users []DiscordUserSummary
+		if err := json.Unmarshal(rec.Body.Bytes(), &users); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return users
+	}
+
+	if users := inactive(); len(users) != 0 {
+		t.Fatalf("a user who just signed in is inactive: %+v", users)
+	}
+	// pretend the cutoff has passed
+	s.config.DiscordInactiveAfter = -time.Hour
+	if users := inactive(); len(users) != 1 {
+		t.Fatalf("got %d inactive users, want 1", len(users))
+	}
+
+	rec := admin(http.MethodPost, "/admin/discord-users/inactive/deactivate")
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"deactivated":1`) {
+		t.Errorf("status %d: %s", rec.Code, rec.Body)
+	}
+	if users := inactive(); len(users) != 0 {
+		t.Errorf("deactivated users are still listed: %+v", users)
+	}
+}
+
+func TestSearchIsAdminOnly(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	ada, token := newTestAccount(t, s, "Ada", "Lovelace")
+	newTestAccount(t, s, "Charles", "Babbage")
+	search := func(admin bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/account?q=love", nil)
+		if admin {
+			req.Header.Set("x-admin-token", s.config.AdminToken)
+		}
+		return serve(s, req, token)
+	}
+
+	wantApiError(t, search(false), http.StatusForbidden, CodeAdminRequired)
+	rec := search(true)
+	var page struct {
+		Accounts []Account `json:"accounts"`
+		Total    int64     `json:"total"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &page); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if page.Total != 1 || len(page.Accounts) != 1 || page.Accounts[0].Id != ada.Id {
+		t.Errorf("got %s, want just Ada", rec.Body)
+	}
+}
+
+func TestStaleVersionIsConflict(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+	update := func(body string) *httptest.ResponseRecorder {
+		return serve(s, httptest.NewRequest(http.MethodPatch, fmt.Sprintf("/account/%d", account.Id), strings.NewReader(body)), token)
+	}
+
+	rec := update(fmt.Sprintf(`{"firstName":"Augusta","version":%d}`, account.Version))
+	var updated Account
+	if err := json.Unmarshal(rec.Body.Bytes(), &updated); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if updated.Version <= account.Version {
+		t.Fatalf("version went from %d to %d", account.Version, updated.Version)
+	}
+
+	// a second client still holding the first version
+	wantApiError(t, update(fmt.Sprintf(`{"lastName":"King","version":%d}`, account.Version)), http.StatusConflict, CodeVersionConflict)
+	// leaving the version out means last write wins
+	if rec := update(`{"lastName":"King"}`); rec.Code != http.StatusOK {
+		t.Errorf("unversioned update: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if _, err := s.store.Deposit(context.Background(), account.Id, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	body := fmt.Sprintf(`{"fromAccount":%d,"toAccount":%d,"amount":100,"version":%d}`, account.Id, to.Id, updated.Version)
+	wantApiError(t, serve(s, httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(body)), token), http.StatusConflict, CodeVersionConflict)
+
+	current, err := s.store.GetAccountById(context.Background(), account.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if current.Balance != 1000 || current.LastName != "King" {
+		t.Errorf("got %+v, want the stale writes refused", current)
+	}
+	body = fmt.Sprintf(`{"fromAccount":%d,"toAccount":%d,"amount":100,"version":%d}`, account.Id, to.Id, current.Version)
+	if rec := serve(s, httptest.NewRequest(http.MethodPost, "/transfer", strings.NewReader(body)), token); rec.Code != http.StatusOK {
+		t.Errorf("transfer at the current version: status %d: %s", rec.Code, rec.Body)
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const discordCdnUrl = "https://cdn.discordapp.com"
+
+// avatarWarmTimeout bounds a background warm-up. It's well under the
+// fetcher's worst case with retries; a warm-up that runs out just leaves the
+// lookup to the next Resolve.
+const avatarWarmTimeout = 5 * time.Second
+
+// defaultAvatarURL is the embed avatar discord shows for users without one.
+// The index comes from the user's snowflake, same as the discord client.
+func defaultAvatarURL(baseURL, userId string) string {
+	id, _ := strconv.ParseUint(userId, 10, 64)
+	return fmt.Sprintf("%s/embed/avatars/%d.png", baseURL, (id>>22)%6)
+}
+
+type cachedAvatar struct {
+	url       string
+	expiresAt time.Time
+}
+
+// avatarFetcher checks a user's avatar against the discord cdn so we only ever
+// hand out urls that resolve. Lookups are cached since avatars rarely change,
+// and a changed avatar has a new hash (and so a new cache key) anyway.
+type avatarFetcher struct {
+	client     *http.Client
+	baseURL    string
+	maxRetries int
+	backoff    time.Duration
+	ttl        time.Duration
+	logger     *slog.Logger
+
+	mu    sync.Mutex
+	cache map[string]cachedAvatar
+}
+
+func newAvatarFetcher(logger *slog.Logger) *avatarFetcher {
+	return &avatarFetcher{
+		client:     &http.Client{Timeout: 3 * time.Second},
+		baseURL:    discordCdnUrl,
+		maxRetries: 2,
+		backoff:    200 * time.Millisecond,
+		ttl:        time.Hour,
+		logger:     logger,
+		cache:      map[string]cachedAvatar{},
+	}
+}
+
+// Resolve returns the url to display for the user's avatar. It never fails:
+// a missing avatar gives the default one, and if the cdn can't be reached the
+// default is returned without being cached so the next call tries again.
+func (f *avatarFetcher) Resolve(ctx context.Context, user *DiscordUser) string {
+	fallback := defaultAvatarURL(f.baseURL, user.Id)
+	if user.Avatar == "" {
+		return fallback
+	}
+
+	key := user.Id + "/" + user.Avatar
+	f.mu.Lock()
+	cached, ok := f.cache[key]
+	f.mu.Unlock()
+	if ok && time.Now().Before(cached.expiresAt) {
+		return cached.url
+	}
+
+	url := fmt.Sprintf("%s/avatars/%s/%s.png", f.baseURL, user.Id, user.Avatar)
+	found, err := f.fetch(ctx, url)
+	if err != nil {
+		f.logger.WarnContext(ctx, "avatar fetch failed", "discord_id", user.Id, "err", err)
+		return fallback
+	}
+	if !found {
+		url = fallback
+	}
+
+	f.mu.Lock()
+	f.cache[key] = cachedAvatar{url: url, expiresAt: time.Now().Add(f.ttl)}
+	f.mu.Unlock()
+	return url
+}
+
+// Warm resolves the user's avatar in the background so the lookup is
+// cached by the time it's asked for. It doesn't share ctx's deadline, so a
+// slow cdn can't use up the time the caller has left.
+func (f *avatarFetcher) Warm(ctx context.Context, user *DiscordUser) {
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), avatarWarmTimeout)
+	go func() {
+		defer cancel()
+		f.Resolve(ctx, user)
+	}()
+}
+
+// prune drops the cached lookups that have expired by now
+func (f *avatarFetcher) prune(now time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for key, cached := range f.cache {
+		if !now.Before(cached.expiresAt) {
+			delete(f.cache, key)
+		}
+	}
+}
+
+// fetch reports whether the cdn has an image at url, retrying server errors
+// and timeouts up to maxRetries times.
+func (f *avatarFetcher) fetch(ctx context.Context, url string) (bool, error) {
+	for attempt := 0; ; attempt++ {
+		found, retry, err := f.try(ctx, url)
+		if !retry || attempt >= f.maxRetries {
+			return found, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return false, ctx.Err()
+		case <-time.After(f.backoff * time.Duration(attempt+1)):
+		}
+	}
+}
+
+func (f *avatarFetcher) try(ctx context.Context, url string) (found bool, retry bool, err error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, url, nil)
+	if err != nil {
+		return false, false, err
+	}
+
+	res, err := f.client.Do(req)
+	if err != nil {
+		// the caller's context going away isn't worth retrying, anything else
+		// (timeouts, resets) probably is
+		return false, ctx.Err() == nil, err
+	}
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusOK:
+		return true, false, nil
+	case res.StatusCode == http.StatusNotFound:
+		return false, false, nil
+	case res.StatusCode >= 500:
+		return false, true, fmt.Errorf("cdn returned %s", res.Status)
+	}
+	return false, false, fmt.Errorf("cdn returned %s", res.Status)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// stubCdn answers avatar lookups with statuses in turn, repeating the last
+func stubCdn(t *testing.T, statuses ...int) (*avatarFetcher, *atomic.Int32) {
+	t.Helper()
+	var calls atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		i := int(calls.Add(1)) - 1
+		w.WriteHeader(statuses[min(i, len(statuses)-1)])
+	}))
+	t.Cleanup(server.Close)
+
+	f := newAvatarFetcher(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	f.baseURL = server.URL
+	f.backoff = time.Millisecond
+	return f, &calls
+}
+
+func TestAvatarResolve(t *testing.T) {
+	user := &DiscordUser{Id: "80351110224678912", Avatar: "8342729096ea3675442027381ff50dfe"}
+	tests := []struct {
+		name      string
+		statuses  []int
+		wantFound bool
+		wantCalls int32
+	}{
+		{"found", []int{http.StatusOK}, true, 1},
+		{"missing", []int{http.StatusNotFound}, false, 1},
+		{"recovers after a server error", []int{http.StatusInternalServerError, http.StatusOK}, true, 2},
+		{"keeps failing", []int{http.StatusBadGateway}, false, 3},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			f, calls := stubCdn(t, test.statuses...)
+			want := defaultAvatarURL(f.baseURL, user.Id)
+			if test.wantFound {
+				want = f.baseURL + "/avatars/" + user.Id + "/" + user.Avatar + ".png"
+			}
+			if got := f.Resolve(context.Background(), user); got != want {
+				t.Errorf("got %q, want %q", got, want)
+			}
+			if calls.Load() != test.wantCalls {
+				t.Errorf("cdn was asked %d times, want %d", calls.Load(), test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestAvatarResolveCaches(t *testing.T) {
+	f, calls := stubCdn(t, http.StatusOK)
+	user := &DiscordUser{Id: "1", Avatar: "abc"}
+	f.Resolve(context.Background(), user)
+	f.Resolve(context.Background(), user)
+	if calls.Load() != 1 {
+		t.Errorf("cdn was asked %d times, want 1", calls.Load())
+	}
+}
+
+func TestAvatarResolveDoesNotCacheFailures(t *testing.T) {
+	f, calls := stubCdn(t, http.StatusServiceUnavailable)
+	f.maxRetries = 0
+	user := &DiscordUser{Id: "1", Avatar: "abc"}
+	f.Resolve(context.Background(), user)
+	f.Resolve(context.Background(), user)
+	if calls.Load() != 2 {
+		t.Errorf("cdn was asked %d times, want 2", calls.Load())
+	}
+}
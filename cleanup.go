@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+// cleaner periodically clears out state that has outlived its use. Sessions,
+// oauth states and verification links are signed tokens that expire on their
+// own, so what's left is what the server keeps about them: the sign outs
+// that stop older sessions working, and the avatar cache. Each run clears at
+// most batchSize sign outs, so a backlog is worked off over several runs
+// rather than holding locks on many rows at once.
+type cleaner struct {
+	store     Storage
+	avatars   *avatarFetcher
+	interval  time.Duration
+	batchSize int
+	now       func() time.Time
+	logger    *slog.Logger
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCleaner(store Storage, avatars *avatarFetcher, interval time.Duration, batchSize int, logger *slog.Logger) *cleaner {
+	return &cleaner{
+		store:     store,
+		avatars:   avatars,
+		interval:  interval,
+		batchSize: batchSize,
+		now:       time.Now,
+		logger:    logger,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+}
+
+// run cleans up every interval until Close is called
+func (c *cleaner) run() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), c.interval)
+			c.cleanup(ctx)
+			cancel()
+		case <-c.stop:
+			return
+		}
+	}
+}
+
+func (c *cleaner) cleanup(ctx context.Context) {
+	now := c.now()
+	// a session can't outlive sessionTtl, so by then every session a sign
+	// out ended has expired without it
+	cleared, err := c.store.ClearExpiredSignOuts(ctx, now.Add(-sessionTtl), c.batchSize)
+	if err != nil {
+		c.logger.ErrorContext(ctx, "clearing expired sign outs", "err", err)
+	} else if cleared > 0 {
+		c.logger.InfoContext(ctx, "cleared expired sign outs", "count", cleared)
+	}
+	c.avatars.prune(now)
+}
+
+// Close stops the cleaner, waiting for a run in progress to finish
+func (c *cleaner) Close() {
+	close(c.stop)
+	<-c.done
+}
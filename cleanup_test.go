@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestCleanerClearsExpiredState(t *testing.T) {
+	store := NewMockStore()
+	now := time.Now()
+	stale := now.Add(-sessionTtl - time.Hour)
+	recent := now.Add(-time.Hour)
+	store.discordUsers["stale"] = &DiscordUser{Id: "stale", SignedOutAt: &stale}
+	store.discordUsers["recent"] = &DiscordUser{Id: "recent", SignedOutAt: &recent}
+
+	avatars := newAvatarFetcher(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	avatars.cache["stale/a"] = cachedAvatar{url: "stale", expiresAt: now.Add(-time.Minute)}
+	avatars.cache["fresh/a"] = cachedAvatar{url: "fresh", expiresAt: now.Add(time.Minute)}
+
+	c := newCleaner(store, avatars, time.Hour, 10, avatars.logger)
+	c.now = func() time.Time { return now }
+	c.cleanup(context.Background())
+
+	if store.discordUsers["stale"].SignedOutAt != nil {
+		t.Error("expired sign out was kept")
+	}
+	if store.discordUsers["recent"].SignedOutAt == nil {
+		t.Error("sign out whose sessions may still be live was cleared")
+	}
+	if _, ok := avatars.cache["stale/a"]; ok {
+		t.Error("expired avatar was kept")
+	}
+	if _, ok := avatars.cache["fresh/a"]; !ok {
+		t.Error("fresh avatar was dropped")
+	}
+}
+
+func TestCleanerClearsOneBatchPerRun(t *testing.T) {
+	store := NewMockStore()
+	stale := time.Now().Add(-2 * sessionTtl)
+	for _, id := range []string{"a", "b", "c"} {
+		store.discordUsers[id] = &DiscordUser{Id: id, SignedOutAt: &stale}
+	}
+
+	c := newCleaner(store, newAvatarFetcher(slog.Default()), time.Hour, 2, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	c.cleanup(context.Background())
+
+	left := 0
+	for _, user := range store.discordUsers {
+		if user.SignedOutAt != nil {
+			left++
+		}
+	}
+	if left != 1 {
+		t.Fatalf("%d expired sign outs left after a batch of 2, want 1", left)
+	}
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"mime"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// compressors are the encodings withCompression can produce, keyed by
+// their Accept-Encoding name. zstd and br would need libraries from outside
+// the standard one, so they aren't on offer.
+var compressors = map[string]func(io.Writer) io.WriteCloser{
+	"gzip": func(w io.Writer) io.WriteCloser { return gzip.NewWriter(w) },
+	"deflate": func(w io.Writer) io.WriteCloser {
+		// only fails for a bad level
+		fw, _ := flate.NewWriter(w, flate.DefaultCompression)
+		return fw
+	},
+}
+
+// defaultCompressExcludeTypes are already compressed, or streams that are
+// read as they arrive
+var defaultCompressExcludeTypes = []string{
+	"image/", "video/", "audio/", "font/woff2",
+	"application/pdf", "application/zip", "application/gzip",
+	"text/event-stream", "application/x-ndjson",
+}
+
+// withCompression compresses responses of at least CompressMinSize bytes
+// with whichever of CompressEncodings the client weights highest, ties
+// going to the order they're configured in. Responses whose type is in
+// CompressExcludeTypes are sent as they are.
+func (s *ApiServer) withCompression(next http.Handler) http.Handler {
+	if len(s.config.CompressEncodings) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"), s.config.CompressEncodings)
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		cw := &compressWriter{
+			ResponseWriter: w,
+			encoding:       encoding,
+			minSize:        s.config.CompressMinSize,
+			excludeTypes:   s.config.CompressExcludeTypes,
+		}
+		defer cw.Close()
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// negotiateEncoding picks the encoding out of offered that acceptEncoding
+// gives the highest q, or "" if it accepts none of them. offered is in our
+// order of preference, which breaks ties.
+func negotiateEncoding(acceptEncoding string, offered []string) string {
+	weights := map[string]float64{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		name, params, _ := strings.Cut(part, ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		q := 1.0
+		for _, param := range strings.Split(params, ";") {
+			key, value, ok := strings.Cut(param, "=")
+			if ok && strings.EqualFold(strings.TrimSpace(key), "q") {
+				if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+					q = parsed
+				}
+			}
+		}
+		weights[name] = q
+	}
+
+	best, bestQ := "", 0.0
+	for _, encoding := range offered {
+		q, ok := weights[encoding]
+		if !ok {
+			q, ok = weights["*"]
+		}
+		if ok && q > bestQ {
+			best, bestQ = encoding, q
+		}
+	}
+	return best
+}
+
+// compressWriter holds the start of a response back until it knows whether
+// to compress it: once minSize bytes have been written, or the handler
+// flushes or returns. The status waits along with it, since compressing
+// changes the headers.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding     string
+	minSize      int
+	excludeTypes []string
+
+	status  int
+	buf     []byte
+	decided bool
+	zw      io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(status int) {
+	if cw.decided {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	// informational responses go straight out, the real one comes after
+	if status < http.StatusOK {
+		cw.ResponseWriter.WriteHeader(status)
+		return
+	}
+	if cw.status == 0 {
+		cw.status = status
+	}
+}
+
+func (cw *compressWriter) Write(b []byte) (int, error) {
+	if !cw.decided {
+		cw.buf = append(cw.buf, b...)
+		if len(cw.buf) < cw.minSize {
+			return len(b), nil
+		}
+		if err := cw.decide(true); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+	if cw.zw != nil {
+		return cw.zw.Write(b)
+	}
+	return cw.ResponseWriter.Write(b)
+}
+
+// decide writes the headers, compressed or not, then whatever has been
+// held back. bigEnough is whether the body is worth compressing.
+func (cw *compressWriter) decide(bigEnough bool) error {
+	cw.decided = true
+	header := cw.Header()
+	// sniffed now, as after this net/http would only see compressed bytes
+	if header.Get("Content-Type") == "" && len(cw.buf) > 0 {
+		header.Set("Content-Type", http.DetectContentType(cw.buf))
+	}
+	if bigEnough && cw.compressible() {
+		header.Set("Content-Encoding", cw.encoding)
+		header.Del("Content-Length")
+		cw.zw = compressors[cw.encoding](cw.ResponseWriter)
+	}
+	if cw.status != 0 {
+		cw.ResponseWriter.WriteHeader(cw.status)
+	}
+
+	buf := cw.buf
+	cw.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if cw.zw != nil {
+		_, err = cw.zw.Write(buf)
+	} else {
+		_, err = cw.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (cw *compressWriter) compressible() bool {
+	switch cw.status {
+	case http.StatusNoContent, http.StatusNotModified, http.StatusPartialContent:
+		return false
+	}
+	header := cw.Header()
+	if header.Get("Content-Encoding") != "" {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil {
+		return true
+	}
+	for _, excluded := range cw.excludeTypes {
+		// "image/" covers every image type, anything else is one exact type
+		if mediaType == excluded || (strings.HasSuffix(excluded, "/") && strings.HasPrefix(mediaType, excluded)) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush sends what's been written so far. A stream that flushes is
+// compressed however little it has sent yet, since more is coming.
+func (cw *compressWriter) Flush() {
+	if !cw.decided {
+		cw.decide(true)
+	}
+	if flusher, ok := cw.zw.(interface{ Flush() error }); ok {
+		flusher.Flush()
+	}
+	if flusher, ok := cw.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// Close sends anything still held back and finishes the compressed stream
+func (cw *compressWriter) Close() error {
+	if !cw.decided {
+		if err := cw.decide(false); err != nil {
+			return err
+		}
+	}
+	if cw.zw != nil {
+		return cw.zw.Close()
+	}
+	return nil
+}
+
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
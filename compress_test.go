@@ -0,0 +1,93 @@
+package main
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNegotiateEncoding(t *testing.T) {
+	offered := []string{"gzip", "deflate"}
+	for acceptEncoding, want := range map[string]string{
+		"":                             "",
+		"identity":                     "",
+		"br":                           "",
+		"gzip":                         "gzip",
+		"deflate":                      "deflate",
+		"deflate, gzip":                "gzip",
+		"gzip;q=0.5, deflate":          "deflate",
+		"GZIP":                         "gzip",
+		"*":                            "gzip",
+		"*;q=0.5, deflate;q=0.8":       "deflate",
+		"gzip;q=0, deflate;q=0":        "",
+		"gzip;q=0, *;q=0.1":            "deflate",
+		" gzip ; q=0.2 ,deflate;q=0.1": "gzip",
+	} {
+		if got := negotiateEncoding(acceptEncoding, offered); got != want {
+			t.Errorf("%q: got %q, want %q", acceptEncoding, got, want)
+		}
+	}
+}
+
+func TestCompressionThreshold(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.CompressEncodings = []string{"gzip", "deflate"}
+	s.config.CompressMinSize = 100
+	s.config.CompressExcludeTypes = defaultCompressExcludeTypes
+
+	for _, test := range []struct {
+		name           string
+		method         string
+		acceptEncoding string
+		contentType    string
+		size           int
+		want           string
+	}{
+		{"big json", http.MethodGet, "gzip", "application/json", 500, "gzip"},
+		{"deflate", http.MethodGet, "deflate", "application/json", 500, "deflate"},
+		{"at the threshold", http.MethodGet, "gzip", "application/json", 100, "gzip"},
+		{"under the threshold", http.MethodGet, "gzip", "application/json", 99, ""},
+		{"not accepted", http.MethodGet, "", "application/json", 500, ""},
+		{"excluded type", http.MethodGet, "gzip", "image/png", 500, ""},
+		{"head", http.MethodHead, "gzip", "application/json", 500, ""},
+	} {
+		body := strings.Repeat("a", test.size)
+		handler := s.withCompression(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", test.contentType)
+			io.WriteString(w, body)
+		}))
+		req := httptest.NewRequest(test.method, "/", nil)
+		if test.acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", test.acceptEncoding)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("Content-Encoding"); got != test.want {
+			t.Errorf("%s: encoding %q, want %q", test.name, got, test.want)
+			continue
+		}
+		if rec.Header().Get("Vary") != "Accept-Encoding" {
+			t.Errorf("%s: Vary is %q", test.name, rec.Header().Get("Vary"))
+		}
+		var r io.Reader = rec.Body
+		switch test.want {
+		case "gzip":
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatalf("%s: %v", test.name, err)
+			}
+			r = zr
+		case "deflate":
+			r = flate.NewReader(rec.Body)
+		}
+		got, err := io.ReadAll(r)
+		if err != nil || string(got) != body {
+			t.Errorf("%s: body came back as %d bytes, %v", test.name, len(got), err)
+		}
+	}
+}
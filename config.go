@@ -0,0 +1,668 @@
+package main
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	EnvProd = "prod"
+	EnvDev  = "dev"
+)
+
+const (
+	RequestIdGenerate = "generate"
+	RequestIdStrict   = "strict"
+)
+
+type Config struct {
+	ListenAddr string
+	// DatabaseUrl is the postgres connection string
+	DatabaseUrl string
+	// ClientId and ClientSecret are the discord oauth app's credentials
+	ClientId     string
+	ClientSecret string
+	// TlsCertFile and TlsKeyFile, when both set, serve https (and with it
+	// http/2) instead of plain http
+	TlsCertFile string
+	TlsKeyFile  string
+	// TlsMinVersion is the oldest tls version accepted, 1.2 or 1.3
+	TlsMinVersion uint16
+	// ReadHeaderTimeout bounds how long a client may take to send its headers,
+	// so slow clients can't hold connections open (slowloris)
+	ReadHeaderTimeout time.Duration
+	ReadTimeout       time.Duration
+	// RequestTimeout is how long a handler has to do its database work (and
+	// anything else taking the request's context) before it's cancelled
+	RequestTimeout time.Duration
+	// StartupTimeout bounds connecting to the database and creating tables
+	StartupTimeout time.Duration
+	// WriteTimeout caps how long a response can take to write. The ndjson
+	// account streams lift it for themselves.
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+	// ShutdownTimeout is how long requests in flight get to finish on shutdown
+	ShutdownTimeout time.Duration
+	// Environment is EnvProd or EnvDev. Dev shows error details on error pages.
+	Environment string
+	// StaticEnabled serves ./static under /static/. Turn it off for api only
+	// deployments.
+	StaticEnabled bool
+	// DisabledStatus is what routes of a switched off feature answer with:
+	// 501 Not Implemented or 403 Forbidden
+	DisabledStatus int
+	// SqlComments tags queries with the request id and route for postgres logs
+	SqlComments bool
+	// CleanupInterval is how often expired state is cleared out, and
+	// CleanupBatchSize the most rows each run clears of each kind
+	CleanupInterval  time.Duration
+	CleanupBatchSize int
+	TransferFee      FeePolicy
+	// DefaultCurrency is the ISO 4217 code new accounts get when they don't
+	// ask for one, and that accounts from before currencies are in
+	DefaultCurrency string
+	// RequestIdMode is what to do when a request comes in without an
+	// X-Request-Id: RequestIdGenerate makes one up, RequestIdStrict refuses it
+	RequestIdMode string
+	// JwtSecrets verify tokens; the first one also signs new ones. Keeping the
+	// old secret after the new one lets tokens survive a rotation.
+	JwtSecrets []string
+	// AdminToken is what the x-admin-token header must carry on admin
+	// routes. It's required, so admin routes are never open by accident.
+	AdminToken string
+	// RequireEmailVerification stops accounts sending transfers until their
+	// owner has followed a verification link
+	RequireEmailVerification bool
+	// SandboxAccounts lets callers mark new accounts as sandbox ones with
+	// the X-Sandbox header or ?sandbox=true
+	SandboxAccounts bool
+	// RevokeKeepsCurrent hands the caller of /me/sessions/revoke-all a new
+	// token, rather than signing them out along with everyone else
+	RevokeKeepsCurrent bool
+	// JwtTtl is how long a token is good for after it's issued
+	JwtTtl time.Duration
+	// DiscordInactiveAfter is how long a discord user can go without signing
+	// in before the admin cleanup counts them as inactive
+	DiscordInactiveAfter time.Duration
+	// MaxBodyBytes is the largest request body decodeJSON reads
+	MaxBodyBytes int64
+	// MaxTransferAmount is the most one transfer may move, in minor units
+	MaxTransferAmount Amount
+	// MaxConcurrentTransfers caps transfers in flight on this instance, since
+	// each one holds a transaction and row locks
+	MaxConcurrentTransfers int
+	// RateLimit is how many requests a second one ip may make to login and
+	// account creation, with bursts of up to RateLimitBurst
+	RateLimit      float64
+	RateLimitBurst int
+	// NormalizeNames trims account names and collapses their inner whitespace
+	// before they're stored. Matching always ignores whitespace and case.
+	NormalizeNames bool
+	// MaxPageOffset is the deepest ?offset= the paginated lists allow
+	MaxPageOffset int
+	// NameLength bounds account first and last names
+	NameLength NameLengthPolicy
+	// AccountNumberGroupSize is how many digits the views show together when
+	// displaying an account number
+	AccountNumberGroupSize int
+	// WelcomePath is where a user's first login lands them
+	WelcomePath string
+	// CorsOrigins may call the api from a browser on another origin. Empty
+	// (the default) allows none.
+	CorsOrigins []string
+	// CompressEncodings are the encodings responses may be compressed with,
+	// most preferred first. Setting COMPRESS_ENCODINGS=none turns
+	// compression off.
+	CompressEncodings []string
+	// CompressMinSize is the smallest body worth compressing, in bytes
+	CompressMinSize int
+	// CompressExcludeTypes are media types sent uncompressed. One ending in
+	// a slash, like image/, covers the whole family.
+	CompressExcludeTypes []string
+	// WebhookUrls are posted to after every transfer
+	WebhookUrls []string
+	// WebhookSecret signs webhook bodies, see webhookSender
+	WebhookSecret string
+	// MetricsToken, if set, is the bearer token /metrics wants from scrapers
+	MetricsToken string
+	// SmtpAddr is the host:port of the mail server notifications are sent
+	// through. Without it they're only logged.
+	SmtpAddr string
+	// SmtpUsername and SmtpPassword log in to the mail server, if it wants
+	SmtpUsername string
+	SmtpPassword string
+	// SmtpFrom is the address notifications come from
+	SmtpFrom string
+	// PublicUrl is where users reach the site, for links in emails
+	PublicUrl string
+	// LogLevel is the least severe level logged: debug, info, warn or error
+	LogLevel slog.Level
+	// LogRedact are the log attribute keys whose values get hashed out
+	LogRedact []string
+	// LogRedactKey keys the hash, so redacted values can't be recovered by
+	// hashing guesses
+	LogRedactKey string
+	// LogRedactKeyGenerated is set when LOG_REDACT_KEY wasn't, and
+	// LogRedactKey was made up for this process
+	LogRedactKeyGenerated bool
+}
+
+// LoadConfig builds the config from, in increasing order of precedence:
+// the defaults below, the file named by CONFIG_FILE (if set), and then the
+// environment. File keys are the env var names in lower case, so
+// STATIC_ENABLED=false and `static_enabled = false` mean the same thing.
+func LoadConfig() (*Config, error) {
+	src := &configSource{used: map[string]bool{}}
+	if path := os.Getenv("CONFIG_FILE"); path != "" {
+		file, err := readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+		src.file = file
+	}
+
+	cfg := &Config{
+		ListenAddr:     src.string("LISTEN_ADDR", ":3000"),
+		Environment:    src.string("ENVIRONMENT", EnvProd),
+		TlsCertFile:    src.string("TLS_CERT_FILE", ""),
+		TlsKeyFile:     src.string("TLS_KEY_FILE", ""),
+		StaticEnabled:  true,
+		NormalizeNames: true,
+	}
+
+	var err error
+	switch minVersion := src.string("TLS_MIN_VERSION", "1.2"); minVersion {
+	case "1.2":
+		cfg.TlsMinVersion = tls.VersionTLS12
+	case "1.3":
+		cfg.TlsMinVersion = tls.VersionTLS13
+	default:
+		// 1.0 and 1.1 are deprecated (RFC 8996) and not on offer
+		return nil, fmt.Errorf("TLS_MIN_VERSION must be 1.2 or 1.3, got %q", minVersion)
+	}
+	if cfg.StaticEnabled, err = src.bool("STATIC_ENABLED", cfg.StaticEnabled); err != nil {
+		return nil, err
+	}
+	disabledStatus, err := src.int("DISABLED_STATUS", http.StatusNotImplemented)
+	if err != nil {
+		return nil, err
+	}
+	cfg.DisabledStatus = int(disabledStatus)
+	if cfg.SqlComments, err = src.bool("SQL_COMMENTS", cfg.SqlComments); err != nil {
+		return nil, err
+	}
+	if cfg.CleanupInterval, err = src.duration("CLEANUP_INTERVAL", time.Hour); err != nil {
+		return nil, err
+	}
+	cleanupBatch, err := src.int("CLEANUP_BATCH_SIZE", 1000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CleanupBatchSize = int(cleanupBatch)
+	if cfg.NormalizeNames, err = src.bool("NORMALIZE_NAMES", cfg.NormalizeNames); err != nil {
+		return nil, err
+	}
+
+	nameMin, err := src.int("NAME_MIN_LENGTH", 1)
+	if err != nil {
+		return nil, err
+	}
+	nameMax, err := src.int("NAME_MAX_LENGTH", 100)
+	if err != nil {
+		return nil, err
+	}
+	cfg.NameLength = NameLengthPolicy{Min: int(nameMin), Max: int(nameMax)}
+
+	flatFee, err := src.int("TRANSFER_FEE_FLAT", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TransferFee.Flat = Amount(flatFee)
+	if cfg.TransferFee.BasisPoints, err = src.int("TRANSFER_FEE_BASIS_POINTS", 0); err != nil {
+		return nil, err
+	}
+	feeAccount, err := src.int("TRANSFER_FEE_ACCOUNT", 0)
+	if err != nil {
+		return nil, err
+	}
+	cfg.TransferFee.Account = int(feeAccount)
+
+	if cfg.ReadHeaderTimeout, err = src.duration("READ_HEADER_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ReadTimeout, err = src.duration("READ_TIMEOUT", 15*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.RequestTimeout, err = src.duration("REQUEST_TIMEOUT", 5*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.StartupTimeout, err = src.duration("STARTUP_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.WriteTimeout, err = src.duration("WRITE_TIMEOUT", 60*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.IdleTimeout, err = src.duration("IDLE_TIMEOUT", 120*time.Second); err != nil {
+		return nil, err
+	}
+	if cfg.ShutdownTimeout, err = src.duration("SHUTDOWN_TIMEOUT", 30*time.Second); err != nil {
+		return nil, err
+	}
+
+	cfg.DefaultCurrency = strings.ToUpper(src.string("DEFAULT_CURRENCY", "USD"))
+	cfg.DatabaseUrl = src.string("DATABASE_URL", defaultDatabaseUrl)
+	cfg.ClientId = src.string("CLIENT_ID", "")
+	cfg.ClientSecret = src.string("CLIENT_SECRET", "")
+
+	cfg.RequestIdMode = src.string("REQUEST_ID_MODE", RequestIdGenerate)
+	cfg.JwtSecrets = src.list("JWT_SECRET")
+	cfg.AdminToken = src.string("ADMIN_TOKEN", "")
+	if cfg.RequireEmailVerification, err = src.bool("REQUIRE_EMAIL_VERIFICATION", false); err != nil {
+		return nil, err
+	}
+	if cfg.SandboxAccounts, err = src.bool("SANDBOX_ACCOUNTS", false); err != nil {
+		return nil, err
+	}
+	if cfg.RevokeKeepsCurrent, err = src.bool("REVOKE_KEEPS_CURRENT", false); err != nil {
+		return nil, err
+	}
+	if cfg.JwtTtl, err = src.duration("JWT_TTL", 15*time.Minute); err != nil {
+		return nil, err
+	}
+	if cfg.DiscordInactiveAfter, err = src.duration("DISCORD_INACTIVE_AFTER", 90*24*time.Hour); err != nil {
+		return nil, err
+	}
+
+	if cfg.MaxBodyBytes, err = src.int("MAX_BODY_BYTES", 1<<20); err != nil {
+		return nil, err
+	}
+
+	maxAmount, err := src.int("MAX_TRANSFER_AMOUNT", 100_000_000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxTransferAmount = Amount(maxAmount)
+
+	maxTransfers, err := src.int("MAX_CONCURRENT_TRANSFERS", 10)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxConcurrentTransfers = int(maxTransfers)
+
+	if cfg.RateLimit, err = src.float("RATE_LIMIT_RPS", 1); err != nil {
+		return nil, err
+	}
+	burst, err := src.int("RATE_LIMIT_BURST", 10)
+	if err != nil {
+		return nil, err
+	}
+	cfg.RateLimitBurst = int(burst)
+
+	maxOffset, err := src.int("MAX_PAGE_OFFSET", 10_000)
+	if err != nil {
+		return nil, err
+	}
+	cfg.MaxPageOffset = int(maxOffset)
+
+	cfg.WelcomePath = src.string("WELCOME_PATH", "/view/welcome")
+
+	groupSize, err := src.int("ACCOUNT_NUMBER_GROUP_SIZE", 4)
+	if err != nil {
+		return nil, err
+	}
+	cfg.AccountNumberGroupSize = int(groupSize)
+
+	cfg.CorsOrigins = src.list("CORS_ALLOWED_ORIGINS")
+
+	if cfg.CompressEncodings = src.list("COMPRESS_ENCODINGS"); len(cfg.CompressEncodings) == 0 {
+		cfg.CompressEncodings = []string{"gzip", "deflate"}
+	} else if len(cfg.CompressEncodings) == 1 && cfg.CompressEncodings[0] == "none" {
+		cfg.CompressEncodings = nil
+	}
+	compressMin, err := src.int("COMPRESS_MIN_SIZE", 1024)
+	if err != nil {
+		return nil, err
+	}
+	cfg.CompressMinSize = int(compressMin)
+	if cfg.CompressExcludeTypes = src.list("COMPRESS_EXCLUDE_TYPES"); len(cfg.CompressExcludeTypes) == 0 {
+		cfg.CompressExcludeTypes = defaultCompressExcludeTypes
+	}
+	cfg.WebhookUrls = src.list("WEBHOOK_URLS")
+	cfg.WebhookSecret = src.string("WEBHOOK_SECRET", "")
+	cfg.MetricsToken = src.string("METRICS_TOKEN", "")
+	cfg.SmtpAddr = src.string("SMTP_ADDR", "")
+	cfg.SmtpUsername = src.string("SMTP_USERNAME", "")
+	cfg.SmtpPassword = src.string("SMTP_PASSWORD", "")
+	cfg.SmtpFrom = src.string("SMTP_FROM", "")
+	cfg.PublicUrl = src.string("PUBLIC_URL", "http://localhost:3000")
+
+	if err := cfg.LogLevel.UnmarshalText([]byte(src.string("LOG_LEVEL", "info"))); err != nil {
+		return nil, fmt.Errorf("LOG_LEVEL must be debug, info, warn or error")
+	}
+	if cfg.LogRedact = src.list("LOG_REDACT"); len(cfg.LogRedact) == 0 {
+		cfg.LogRedact = defaultLogRedact
+	}
+	cfg.LogRedactKey = src.string("LOG_REDACT_KEY", "")
+	// without one each process makes its own. Redacted values still can't be
+	// recovered, they just stop matching across restarts and instances.
+	if cfg.LogRedactKey == "" {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return nil, fmt.Errorf("generating a log redaction key: %w", err)
+		}
+		cfg.LogRedactKey = hex.EncodeToString(key)
+		cfg.LogRedactKeyGenerated = true
+	}
+
+	if err := src.checkUnused(); err != nil {
+		return nil, err
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// defaultDatabaseUrl is the database docker compose runs
+const defaultDatabaseUrl = "postgresql://gobank:gobank@db/gobank?sslmode=disable"
+
+func (c *Config) validate() error {
+	missing := []string{}
+	for key, value := range map[string]string{
+		"CLIENT_ID":     c.ClientId,
+		"CLIENT_SECRET": c.ClientSecret,
+		"ADMIN_TOKEN":   c.AdminToken,
+	} {
+		if value == "" {
+			missing = append(missing, key)
+		}
+	}
+	if len(c.JwtSecrets) == 0 {
+		missing = append(missing, "JWT_SECRET")
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return fmt.Errorf("missing required settings: %s", strings.Join(missing, ", "))
+	}
+	if _, _, err := net.SplitHostPort(c.ListenAddr); err != nil {
+		return fmt.Errorf("LISTEN_ADDR %q is not a valid host:port", c.ListenAddr)
+	}
+	if c.CleanupInterval <= 0 || c.CleanupBatchSize < 1 {
+		return fmt.Errorf("CLEANUP_INTERVAL must be positive and CLEANUP_BATCH_SIZE at least 1")
+	}
+	if c.Environment != EnvProd && c.Environment != EnvDev {
+		return fmt.Errorf("ENVIRONMENT must be %q or %q", EnvProd, EnvDev)
+	}
+	if (c.TlsCertFile == "") != (c.TlsKeyFile == "") {
+		return fmt.Errorf("TLS_CERT_FILE and TLS_KEY_FILE must be set together")
+	}
+	if c.ReadHeaderTimeout <= 0 {
+		return fmt.Errorf("READ_HEADER_TIMEOUT must be positive")
+	}
+	if c.RequestTimeout <= 0 || c.StartupTimeout <= 0 {
+		return fmt.Errorf("REQUEST_TIMEOUT and STARTUP_TIMEOUT must be positive")
+	}
+	if c.RequestIdMode != RequestIdGenerate && c.RequestIdMode != RequestIdStrict {
+		return fmt.Errorf("REQUEST_ID_MODE must be %q or %q", RequestIdGenerate, RequestIdStrict)
+	}
+	if c.JwtTtl <= 0 {
+		return fmt.Errorf("JWT_TTL must be positive")
+	}
+	if c.DiscordInactiveAfter <= 0 {
+		return fmt.Errorf("DISCORD_INACTIVE_AFTER must be positive")
+	}
+	// a relative path keeps the login redirect on this site
+	if !strings.HasPrefix(c.WelcomePath, "/") || strings.HasPrefix(c.WelcomePath, "//") {
+		return fmt.Errorf("WELCOME_PATH must be a path starting with /")
+	}
+	if c.DisabledStatus != http.StatusNotImplemented && c.DisabledStatus != http.StatusForbidden {
+		return fmt.Errorf("DISABLED_STATUS must be 501 or 403")
+	}
+	if c.AccountNumberGroupSize < 1 {
+		return fmt.Errorf("ACCOUNT_NUMBER_GROUP_SIZE must be at least 1")
+	}
+	if c.MaxBodyBytes < 1 {
+		return fmt.Errorf("MAX_BODY_BYTES must be at least 1")
+	}
+	if c.MaxTransferAmount < 1 {
+		return fmt.Errorf("MAX_TRANSFER_AMOUNT must be at least 1")
+	}
+	if c.MaxConcurrentTransfers < 1 {
+		return fmt.Errorf("MAX_CONCURRENT_TRANSFERS must be at least 1")
+	}
+	for _, origin := range c.CorsOrigins {
+		// origins are matched exactly, so a wildcard would never match anything
+		if u, err := url.Parse(origin); err != nil || u.Scheme == "" || u.Host == "" || u.Path != "" {
+			return fmt.Errorf("CORS_ALLOWED_ORIGINS has an invalid origin %q, want scheme://host[:port]", origin)
+		}
+	}
+	// an unsigned webhook can't be told apart from a forged one
+	if len(c.WebhookUrls) > 0 && c.WebhookSecret == "" {
+		return fmt.Errorf("WEBHOOK_SECRET must be set when WEBHOOK_URLS is")
+	}
+	if c.SmtpAddr != "" {
+		if _, _, err := net.SplitHostPort(c.SmtpAddr); err != nil {
+			return fmt.Errorf("SMTP_ADDR must be host:port, got %q", c.SmtpAddr)
+		}
+		if _, err := mail.ParseAddress(c.SmtpFrom); err != nil {
+			return fmt.Errorf("SMTP_FROM must be an email address when SMTP_ADDR is set")
+		}
+	}
+	if u, err := url.Parse(c.PublicUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("PUBLIC_URL has an invalid url %q", c.PublicUrl)
+	}
+	for _, webhookUrl := range c.WebhookUrls {
+		if u, err := url.Parse(webhookUrl); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("WEBHOOK_URLS has an invalid url %q", webhookUrl)
+		}
+	}
+	for _, encoding := range c.CompressEncodings {
+		if compressors[encoding] == nil {
+			return fmt.Errorf("COMPRESS_ENCODINGS has unsupported encoding %q, want gzip, deflate or none", encoding)
+		}
+	}
+	if c.CompressMinSize < 0 {
+		return fmt.Errorf("COMPRESS_MIN_SIZE cannot be negative")
+	}
+	if c.RateLimit <= 0 || c.RateLimitBurst < 1 {
+		return fmt.Errorf("RATE_LIMIT_RPS must be positive and RATE_LIMIT_BURST at least 1")
+	}
+	if !validCurrency(c.DefaultCurrency) {
+		return fmt.Errorf("DEFAULT_CURRENCY %q is not an ISO 4217 currency code", c.DefaultCurrency)
+	}
+	if c.MaxPageOffset < 0 {
+		return fmt.Errorf("MAX_PAGE_OFFSET cannot be negative")
+	}
+	if err := c.NameLength.validate(); err != nil {
+		return err
+	}
+	return c.TransferFee.validate()
+}
+
+// configSource looks keys up in the environment, then the config file.
+// It remembers which keys were asked for so typos in the file get caught.
+type configSource struct {
+	file map[string]string
+	used map[string]bool
+}
+
+func (c *configSource) lookup(key string) (string, bool) {
+	c.used[key] = true
+	if v, ok := os.LookupEnv(key); ok && v != "" {
+		return v, true
+	}
+	v, ok := c.file[key]
+	return v, ok
+}
+
+func (c *configSource) string(key, def string) string {
+	if v, ok := c.lookup(key); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+func (c *configSource) bool(key string, def bool) (bool, error) {
+	v, ok := c.lookup(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	b, err := strconv.ParseBool(v)
+	if err != nil {
+		return def, fmt.Errorf("%s must be a boolean, got %q", key, v)
+	}
+	return b, nil
+}
+
+func (c *configSource) int(key string, def int64) (int64, error) {
+	v, ok := c.lookup(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return def, fmt.Errorf("%s must be an integer, got %q", key, v)
+	}
+	return n, nil
+}
+
+func (c *configSource) float(key string, def float64) (float64, error) {
+	v, ok := c.lookup(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return def, fmt.Errorf("%s must be a number, got %q", key, v)
+	}
+	return f, nil
+}
+
+// duration reads a go duration such as 5s or 1m30s
+func (c *configSource) duration(key string, def time.Duration) (time.Duration, error) {
+	v, ok := c.lookup(key)
+	if !ok || v == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return def, fmt.Errorf("%s must be a duration like 10s, got %q", key, v)
+	}
+	return d, nil
+}
+
+// list reads a comma separated value, dropping empty entries
+func (c *configSource) list(key string) []string {
+	v, _ := c.lookup(key)
+	items := []string{}
+	for _, item := range strings.Split(v, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (c *configSource) checkUnused() error {
+	unknown := []string{}
+	for key := range c.file {
+		if !c.used[key] {
+			unknown = append(unknown, strings.ToLower(key))
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return fmt.Errorf("unknown config keys: %s", strings.Join(unknown, ", "))
+	}
+	return nil
+}
+
+// readConfigFile reads the flat subset of toml we need: `key = value` lines,
+// where value is a quoted string, a number or a boolean, plus # comments.
+// Tables and arrays aren't supported since every setting is a single value.
+func readConfigFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	defer f.Close()
+
+	values := map[string]string{}
+	scanner := bufio.NewScanner(f)
+	for lineNo := 1; scanner.Scan(); lineNo++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		key, value, ok := strings.Cut(line, "=")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t[]\"'") {
+			return nil, fmt.Errorf("%s:%d: expected key = value", path, lineNo)
+		}
+
+		value, err := parseConfigValue(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", path, lineNo, err)
+		}
+		values[strings.ToUpper(key)] = value
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("reading config file: %w", err)
+	}
+	return values, nil
+}
+
+func parseConfigValue(raw string) (string, error) {
+	switch {
+	case strings.HasPrefix(raw, `"`):
+		end := closingQuote(raw)
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		if rest := strings.TrimSpace(raw[end+1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return "", fmt.Errorf("unexpected text after string: %s", rest)
+		}
+		return strconv.Unquote(raw[:end+1])
+	case strings.HasPrefix(raw, "'"):
+		end := strings.Index(raw[1:], "'")
+		if end < 0 {
+			return "", fmt.Errorf("unterminated string")
+		}
+		return raw[1 : end+1], nil
+	}
+
+	// bare values: numbers and booleans, possibly followed by a comment
+	value, _, _ := strings.Cut(raw, "#")
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return "", fmt.Errorf("missing value")
+	}
+	return value, nil
+}
+
+// closingQuote finds the quote ending the basic string at the start of raw
+func closingQuote(raw string) int {
+	for i := 1; i < len(raw); i++ {
+		switch raw[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return -1
+}
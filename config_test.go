@@ -0,0 +1,148 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// requiredConfig is the least config LoadConfig accepts
+var requiredConfig = map[string]string{
+	"JWT_SECRET":    "test-jwt-secret-that-is-long-enough",
+	"CLIENT_ID":     "test-client",
+	"CLIENT_SECRET": "test-client-secret",
+	"ADMIN_TOKEN":   "test-admin-token",
+}
+
+func setRequiredConfig(t *testing.T) {
+	t.Helper()
+	for key, value := range requiredConfig {
+		t.Setenv(key, value)
+	}
+}
+
+// writeConfigFile points CONFIG_FILE at a file holding contents
+func writeConfigFile(t *testing.T, contents string) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "chorse.conf")
+	if err := os.WriteFile(path, []byte(contents), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("CONFIG_FILE", path)
+}
+
+func TestConfigFile(t *testing.T) {
+	setRequiredConfig(t)
+	t.Setenv("LISTEN_ADDR", "")
+	t.Setenv("STATIC_ENABLED", "")
+	writeConfigFile(t, `
+# set in the file only
+listen_addr = ":4000"
+static_enabled = false
+`)
+
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddr != ":4000" {
+		t.Errorf("ListenAddr = %q, want the file's :4000", config.ListenAddr)
+	}
+	if config.StaticEnabled {
+		t.Error("StaticEnabled is true, want the file's false")
+	}
+
+	t.Setenv("LISTEN_ADDR", ":5000")
+	config, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.ListenAddr != ":5000" {
+		t.Errorf("ListenAddr = %q, want the environment's :5000", config.ListenAddr)
+	}
+}
+
+func TestConfigFileInvalid(t *testing.T) {
+	setRequiredConfig(t)
+	for _, contents := range []string{
+		"listen_addr",
+		`listen_addr = ":4000`,
+		`listen addr = ":4000"`,
+	} {
+		writeConfigFile(t, contents)
+		_, err := LoadConfig()
+		if err == nil || !strings.Contains(err.Error(), ":1:") {
+			t.Errorf("%s: err = %v, want one naming the line", contents, err)
+		}
+	}
+
+	t.Setenv("CONFIG_FILE", filepath.Join(t.TempDir(), "missing.conf"))
+	if _, err := LoadConfig(); err == nil {
+		t.Error("a missing config file loaded")
+	}
+}
+
+func TestMissingRequiredConfig(t *testing.T) {
+	for key := range requiredConfig {
+		setRequiredConfig(t)
+		t.Setenv(key, "")
+		_, err := LoadConfig()
+		if err == nil || !strings.Contains(err.Error(), key) {
+			t.Errorf("without %s: err = %v, want one naming it", key, err)
+		}
+	}
+
+	setRequiredConfig(t)
+	t.Setenv("CLIENT_ID", "")
+	t.Setenv("ADMIN_TOKEN", "")
+	_, err := LoadConfig()
+	if err == nil || !strings.Contains(err.Error(), "ADMIN_TOKEN, CLIENT_ID") {
+		t.Errorf("err = %v, want every missing setting named", err)
+	}
+}
+
+func TestLogRedactKey(t *testing.T) {
+	setRequiredConfig(t)
+	t.Setenv("LOG_REDACT_KEY", "")
+	first, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !first.LogRedactKeyGenerated || len(first.LogRedactKey) != 64 || first.LogRedactKey == second.LogRedactKey {
+		t.Errorf("without LOG_REDACT_KEY got keys %q and %q, want a fresh one each time", first.LogRedactKey, second.LogRedactKey)
+	}
+
+	t.Setenv("LOG_REDACT_KEY", "configured")
+	config, err := LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.LogRedactKeyGenerated || config.LogRedactKey != "configured" {
+		t.Errorf("got key %q (generated %t), want the configured one", config.LogRedactKey, config.LogRedactKeyGenerated)
+	}
+}
+
+func TestDefaultCurrency(t *testing.T) {
+	setRequiredConfig(t)
+	for value, want := range map[string]string{"": "USD", "eur": "EUR", "GBP": "GBP"} {
+		t.Setenv("DEFAULT_CURRENCY", value)
+		config, err := LoadConfig()
+		if err != nil {
+			t.Fatalf("DEFAULT_CURRENCY=%q: %v", value, err)
+		}
+		if config.DefaultCurrency != want {
+			t.Errorf("DEFAULT_CURRENCY=%q: got %s, want %s", value, config.DefaultCurrency, want)
+		}
+	}
+	for _, value := range []string{"XYZ", "dollars", "US"} {
+		t.Setenv("DEFAULT_CURRENCY", value)
+		if _, err := LoadConfig(); err == nil || !strings.Contains(err.Error(), "DEFAULT_CURRENCY") {
+			t.Errorf("DEFAULT_CURRENCY=%q: err = %v", value, err)
+		}
+	}
+}
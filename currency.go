@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// isoCurrencies are the active ISO 4217 currency codes, leaving out funds,
+// metals and the testing codes
+var isoCurrencies = map[string]bool{}
+
+func init() {
+	for _, code := range strings.Fields(`
+		AED AFN ALL AMD ANG AOA ARS AUD AWG AZN BAM BBD BDT BGN BHD BIF BMD BND
+		BOB BRL BSD BTN BWP BYN BZD CAD CDF CHF CLP CNY COP CRC CUP CVE CZK DJF
+		DKK DOP DZD EGP ERN ETB EUR FJD FKP GBP GEL GHS GIP GMD GNF GTQ GYD HKD
+		HNL HTG HUF IDR ILS INR IQD IRR ISK JMD JOD JPY KES KGS KHR KMF KPW KRW
+		KWD KYD KZT LAK LBP LKR LRD LSL LYD MAD MDL MGA MKD MMK MNT MOP MRU MUR
+		MVR MWK MXN MYR MZN NAD NGN NIO NOK NPR NZD OMR PAB PEN PGK PHP PKR PLN
+		PYG QAR RON RSD RUB RWF SAR SBD SCR SDG SEK SGD SHP SLE SOS SRD SSP STN
+		SVC SYP SZL THB TJS TMT TND TOP TRY TTD TWD TZS UAH UGX USD UYU UZS VES
+		VND VUV WST XAF XCD XCG XOF XPF YER ZAR ZMW ZWG`) {
+		isoCurrencies[code] = true
+	}
+}
+
+// currencyDecimals are the currencies whose minor unit isn't a hundredth.
+// Amounts are always stored in minor units, so 1000 is ¥1000 but $10.00.
+var currencyDecimals = map[string]int{
+	"BIF": 0, "CLP": 0, "DJF": 0, "GNF": 0, "ISK": 0, "JPY": 0, "KMF": 0, "KRW": 0,
+	"PYG": 0, "RWF": 0, "UGX": 0, "VND": 0, "VUV": 0, "XAF": 0, "XOF": 0, "XPF": 0,
+	"BHD": 3, "IQD": 3, "JOD": 3, "KWD": 3, "LYD": 3, "OMR": 3, "TND": 3,
+}
+
+func validCurrency(code string) bool {
+	return isoCurrencies[code]
+}
+
+// formatMoney renders an amount in the currency's minor units, e.g. -1234 USD
+// is -$12.34 and 1234 EUR is 12.34 EUR
+func formatMoney(amount Amount, currency string) string {
+	// plain int64 from here on, as Sprint on an Amount would come back here
+	cents := int64(amount)
+	sign := ""
+	if cents < 0 {
+		sign = "-"
+		cents = -cents
+	}
+
+	decimals, ok := currencyDecimals[currency]
+	if !ok {
+		decimals = 2
+	}
+	value := fmt.Sprint(cents)
+	if decimals > 0 {
+		scale := int64(1)
+		for range decimals {
+			scale *= 10
+		}
+		value = fmt.Sprintf("%d.%0*d", cents/scale, decimals, cents%scale)
+	}
+
+	if currency == "USD" {
+		return sign + "$" + value
+	}
+	return sign + value + " " + currency
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// ErrorCode is the machine readable half of an ApiError. Codes are part of
+// the api: clients branch on them, so once one has shipped it keeps its
+// meaning, and messages are free to change around it.
+type ErrorCode string
+
+const (
+	CodeInvalidRequest    ErrorCode = "invalid_request"
+	CodeValidationFailed  ErrorCode = "validation_failed"
+	CodeMissingToken      ErrorCode = "missing_token"
+	CodeInvalidToken      ErrorCode = "invalid_token"
+	CodeTokenExpired      ErrorCode = "token_expired"
+	CodeTokenRevoked      ErrorCode = "token_revoked"
+	CodeNotSignedIn       ErrorCode = "not_signed_in"
+	CodeForbidden         ErrorCode = "forbidden"
+	CodeNotYourAccount    ErrorCode = "not_your_account"
+	CodeAdminRequired     ErrorCode = "admin_required"
+	CodeOriginNotAllowed  ErrorCode = "origin_not_allowed"
+	CodeNotFound          ErrorCode = "not_found"
+	CodeAccountNotFound   ErrorCode = "account_not_found"
+	CodeMethodNotAllowed  ErrorCode = "method_not_allowed"
+	CodeDuplicate         ErrorCode = "duplicate"
+	CodeVersionConflict   ErrorCode = "version_conflict"
+	CodeInsufficientFunds ErrorCode = "insufficient_funds"
+	CodeBalanceOutOfRange ErrorCode = "balance_out_of_range"
+	CodeSameAccount       ErrorCode = "same_account"
+	CodeNotWhitelisted    ErrorCode = "not_whitelisted"
+	CodeCurrencyMismatch  ErrorCode = "currency_mismatch"
+	CodeEmailUnverified   ErrorCode = "email_unverified"
+	CodeInvalidRate       ErrorCode = "invalid_rate"
+	CodeInvalidRequestId  ErrorCode = "invalid_request_id"
+	CodeFeatureDisabled   ErrorCode = "feature_disabled"
+	CodeRateLimited       ErrorCode = "rate_limited"
+	CodeBusy              ErrorCode = "busy"
+	CodeInternal          ErrorCode = "internal_error"
+)
+
+// codeForStatus is the code for an error nothing more specific is known
+// about than its status
+func codeForStatus(status int) ErrorCode {
+	switch status {
+	case http.StatusUnauthorized:
+		return CodeNotSignedIn
+	case http.StatusForbidden:
+		return CodeForbidden
+	case http.StatusNotFound:
+		return CodeNotFound
+	case http.StatusMethodNotAllowed:
+		return CodeMethodNotAllowed
+	case http.StatusConflict:
+		return CodeDuplicate
+	case http.StatusUnprocessableEntity:
+		return CodeValidationFailed
+	case http.StatusTooManyRequests:
+		return CodeRateLimited
+	case http.StatusServiceUnavailable:
+		return CodeBusy
+	}
+	if status >= 500 {
+		return CodeInternal
+	}
+	return CodeInvalidRequest
+}
+
+// tokenErrorCode tells apart the ways authenticate rejects a token
+func tokenErrorCode(err error) ErrorCode {
+	switch {
+	case errors.Is(err, ErrNoToken):
+		return CodeMissingToken
+	case errors.Is(err, ErrTokenExpired):
+		return CodeTokenExpired
+	case errors.Is(err, ErrTokenRevoked):
+		return CodeTokenRevoked
+	}
+	return CodeInvalidToken
+}
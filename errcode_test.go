@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCodeForStatus(t *testing.T) {
+	for status, want := range map[int]ErrorCode{
+		http.StatusBadRequest:            CodeInvalidRequest,
+		http.StatusUnauthorized:          CodeNotSignedIn,
+		http.StatusForbidden:             CodeForbidden,
+		http.StatusNotFound:              CodeNotFound,
+		http.StatusMethodNotAllowed:      CodeMethodNotAllowed,
+		http.StatusConflict:              CodeDuplicate,
+		http.StatusRequestEntityTooLarge: CodeInvalidRequest,
+		http.StatusUnprocessableEntity:   CodeValidationFailed,
+		http.StatusTooManyRequests:       CodeRateLimited,
+		http.StatusInternalServerError:   CodeInternal,
+		http.StatusBadGateway:            CodeInternal,
+		http.StatusServiceUnavailable:    CodeBusy,
+	} {
+		if got := codeForStatus(status); got != want {
+			t.Errorf("codeForStatus(%d) = %s, want %s", status, got, want)
+		}
+	}
+}
+
+func TestTokenErrorCode(t *testing.T) {
+	for err, want := range map[error]ErrorCode{
+		ErrNoToken: CodeMissingToken,
+		fmt.Errorf("parsing: %w", ErrTokenExpired): CodeTokenExpired,
+		ErrTokenRevoked:                    CodeTokenRevoked,
+		fmt.Errorf("signature is invalid"): CodeInvalidToken,
+	} {
+		if got := tokenErrorCode(err); got != want {
+			t.Errorf("tokenErrorCode(%v) = %s, want %s", err, got, want)
+		}
+	}
+}
+
+func TestInsufficientFundsIsTheSameEverywhere(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+
+	path := fmt.Sprintf("/account/%d/withdraw", from.Id)
+	withdraw := serve(s, httptest.NewRequest(http.MethodPost, path, strings.NewReader(`{"amount":10}`)), token)
+	wantApiError(t, withdraw, http.StatusUnprocessableEntity, CodeInsufficientFunds)
+	wantApiError(t, transfer(s, token, from.Id, to.Id, 10), http.StatusUnprocessableEntity, CodeInsufficientFunds)
+}
+
+func TestTransferErrorCodes(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	from, token := newTestAccount(t, s, "Ada", "Lovelace")
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+	if _, err := s.store.Deposit(context.Background(), from.Id, 100, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	wantApiError(t, transfer(s, "", from.Id, to.Id, 10), http.StatusUnauthorized, CodeMissingToken)
+	wantApiError(t, transfer(s, "not-a-jwt", from.Id, to.Id, 10), http.StatusForbidden, CodeInvalidToken)
+	wantApiError(t, transfer(s, token, from.Id, from.Id, 10), http.StatusBadRequest, CodeSameAccount)
+	wantApiError(t, transfer(s, token, from.Id, to.Id, 1000), http.StatusUnprocessableEntity, CodeInsufficientFunds)
+	wantApiError(t, transfer(s, token, from.Id, 999999, 10), http.StatusNotFound, CodeAccountNotFound)
+	wantApiError(t, transfer(s, token, to.Id, from.Id, 10), http.StatusForbidden, CodeNotYourAccount)
+}
+
+func TestTransferFromUnknownAccountLooksNotYours(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	_, token := newTestAccount(t, s, "Ada", "Lovelace")
+	other, _ := newTestAccount(t, s, "Charles", "Babbage")
+
+	// someone else's account and no account at all get the same answer
+	wantApiError(t, transfer(s, token, other.Id, other.Id+1, 10), http.StatusForbidden, CodeNotYourAccount)
+	wantApiError(t, transfer(s, token, 999999, other.Id, 10), http.StatusForbidden, CodeNotYourAccount)
+}
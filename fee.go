@@ -0,0 +1,35 @@
+package main
+
+import "fmt"
+
+// FeePolicy is what sending a transfer costs: a flat amount plus a share of
+// the amount sent. The share is in basis points (1/100th of a percent) so the
+// maths stays in whole cents.
+type FeePolicy struct {
+	Flat        Amount
+	BasisPoints int64
+	// Account is the id of the account collecting fees. Zero means fees are
+	// only debited from the sender and not credited anywhere.
+	Account int
+}
+
+// Fee for sending amount. The percentage part rounds half up to the cent.
+func (p FeePolicy) Fee(amount Amount) Amount {
+	// split the multiplication so large amounts can't overflow
+	whole := int64(amount) / 10_000 * p.BasisPoints
+	part := (int64(amount)%10_000*p.BasisPoints + 5_000) / 10_000
+	return p.Flat + Amount(whole+part)
+}
+
+func (p FeePolicy) validate() error {
+	if p.Flat < 0 {
+		return fmt.Errorf("TRANSFER_FEE_FLAT cannot be negative")
+	}
+	if p.BasisPoints < 0 || p.BasisPoints > 10_000 {
+		return fmt.Errorf("TRANSFER_FEE_BASIS_POINTS must be between 0 and 10000")
+	}
+	if p.Account < 0 {
+		return fmt.Errorf("TRANSFER_FEE_ACCOUNT must be an account id")
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package main
+
+import "testing"
+
+func TestFee(t *testing.T) {
+	tests := []struct {
+		policy FeePolicy
+		amount Amount
+		want   Amount
+	}{
+		{FeePolicy{}, 10_000, 0},
+		{FeePolicy{Flat: 25}, 10_000, 25},
+		{FeePolicy{Flat: 25}, 1, 25},
+		{FeePolicy{BasisPoints: 150}, 10_000, 150},
+		// 1.5% of 1001 is 15.015, rounding down
+		{FeePolicy{BasisPoints: 150}, 1001, 15},
+		// 1% of 50 is 0.5, rounding half up
+		{FeePolicy{BasisPoints: 100}, 50, 1},
+		{FeePolicy{Flat: 25, BasisPoints: 100}, 10_000, 125},
+		// large enough that amount * basis points would overflow
+		{FeePolicy{BasisPoints: 10_000}, 1 << 60, 1 << 60},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Fee(tt.amount); got != tt.want {
+			t.Errorf("%+v.Fee(%d) = %d, want %d", tt.policy, tt.amount, got, tt.want)
+		}
+	}
+}
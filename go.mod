@@ -3,6 +3,7 @@ module github.com/bdubose/chorse-go
 go 1.22.0
 
 require (
+	github.com/go-pdf/fpdf v0.9.0
 	github.com/golang-jwt/jwt/v4 v4.5.0
 	github.com/jackc/pgx/v5 v5.5.3
 	github.com/ravener/discord-oauth2 v0.0.0-20230514095040-ae65713199b3
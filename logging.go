@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"strings"
+)
+
+// defaultLogRedact are the attribute keys that hold personal details
+var defaultLogRedact = []string{"first_name", "last_name", "name", "email", "discord_id", "global_name"}
+
+// redactingHandler replaces the values of personal attributes, wherever they
+// are nested, with a short keyed hash before they reach the wrapped handler.
+// The hash still lets you tell whether two lines are about the same person,
+// but without the key nobody can check a guess against it.
+// Ids aren't personal and pass through, since they're what ties lines together.
+type redactingHandler struct {
+	slog.Handler
+	fields map[string]bool
+	key    []byte
+}
+
+func newRedactingHandler(h slog.Handler, fields []string, key string) *redactingHandler {
+	set := map[string]bool{}
+	for _, field := range fields {
+		set[strings.ToLower(field)] = true
+	}
+	return &redactingHandler{Handler: h, fields: set, key: []byte(key)}
+}
+
+func (h *redactingHandler) Handle(ctx context.Context, r slog.Record) error {
+	redacted := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		redacted.AddAttrs(h.redact(a))
+		return true
+	})
+	return h.Handler.Handle(ctx, redacted)
+}
+
+func (h *redactingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = h.redact(a)
+	}
+	return &redactingHandler{Handler: h.Handler.WithAttrs(redacted), fields: h.fields, key: h.key}
+}
+
+func (h *redactingHandler) WithGroup(name string) slog.Handler {
+	return &redactingHandler{Handler: h.Handler.WithGroup(name), fields: h.fields, key: h.key}
+}
+
+func (h *redactingHandler) redact(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		group := a.Value.Group()
+		redacted := make([]slog.Attr, len(group))
+		for i, member := range group {
+			redacted[i] = h.redact(member)
+		}
+		return slog.Attr{Key: a.Key, Value: slog.GroupValue(redacted...)}
+	}
+	if h.fields[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, maskPII(h.key, a.Value.String()))
+	}
+	return a
+}
+
+func maskPII(key []byte, value string) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(value))
+	return "redacted:" + hex.EncodeToString(mac.Sum(nil)[:6])
+}
+
+// requestIdHandler adds the request id to anything logged with a request's
+// context, so every line about a request can be found from its id, and the
+// correlation id when the request has a session, so every request of the
+// session can be found too
+type requestIdHandler struct {
+	slog.Handler
+}
+
+func (h requestIdHandler) Handle(ctx context.Context, r slog.Record) error {
+	if tags, ok := ctx.Value(queryTagsKey{}).(queryTags); ok {
+		r.AddAttrs(slog.String("request_id", tags.RequestId))
+		if tags.CorrelationId != "" {
+			r.AddAttrs(slog.String("correlation_id", tags.CorrelationId))
+		}
+	}
+	return h.Handler.Handle(ctx, r)
+}
+
+func (h requestIdHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return requestIdHandler{h.Handler.WithAttrs(attrs)}
+}
+
+func (h requestIdHandler) WithGroup(name string) slog.Handler {
+	return requestIdHandler{h.Handler.WithGroup(name)}
+}
@@ -0,0 +1,49 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"strings"
+	"testing"
+)
+
+func TestRedactingHandlerMasksNames(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(newRedactingHandler(slog.NewJSONHandler(&buf, nil), defaultLogRedact, "test-key"))
+
+	logger.With("account_id", 42).Info("created account",
+		"first_name", "Ada",
+		slog.Group("account", "last_name", "Lovelace", "id", 42),
+	)
+
+	var line struct {
+		AccountId float64 `json:"account_id"`
+		FirstName string  `json:"first_name"`
+		Account   struct {
+			LastName string  `json:"last_name"`
+			Id       float64 `json:"id"`
+		} `json:"account"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(buf.String(), "Ada") || strings.Contains(buf.String(), "Lovelace") {
+		t.Errorf("names got into the log: %s", buf.String())
+	}
+	if !strings.HasPrefix(line.FirstName, "redacted:") || !strings.HasPrefix(line.Account.LastName, "redacted:") {
+		t.Errorf("names weren't replaced with hashes: %s", buf.String())
+	}
+	if line.AccountId != 42 || line.Account.Id != 42 {
+		t.Errorf("ids should pass through: %s", buf.String())
+	}
+}
+
+func TestMaskPIIIsKeyed(t *testing.T) {
+	if maskPII([]byte("a"), "Ada") != maskPII([]byte("a"), "Ada") {
+		t.Error("same value and key hashed differently")
+	}
+	if maskPII([]byte("a"), "Ada") == maskPII([]byte("b"), "Ada") {
+		t.Error("hash doesn't depend on the key")
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"context"
 	"log"
+	"log/slog"
 	"os"
 
 	"github.com/ravener/discord-oauth2"
@@ -9,27 +11,41 @@ import (
 )
 
 func main() {
-	// disable ssl mode for lib/pq
-	conStr := "postgresql://gobank:gobank@db/gobank?sslmode=disable"
-	store, err := NewPostgresStore(conStr)
+	config, err := LoadConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	textHandler := slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: config.LogLevel})
+	slog.SetDefault(slog.New(requestIdHandler{newRedactingHandler(textHandler, config.LogRedact, config.LogRedactKey)}))
+	if config.LogRedactKeyGenerated {
+		slog.Warn("LOG_REDACT_KEY is not set, so redacted log values won't match across restarts or instances")
+	}
+
+	// a database that's down or locked shouldn't leave startup hanging
+	ctx, cancel := context.WithTimeout(context.Background(), config.StartupTimeout)
+	store, err := NewPostgresStore(ctx, config.DatabaseUrl, config.SqlComments)
 	if err != nil {
 		log.Fatal(err)
 	}
 
-	if err := store.Init(); err != nil {
+	if err := store.Init(ctx, config.DefaultCurrency); err != nil {
 		log.Fatal(err)
 	}
+	cancel()
 
-	clientId := os.Getenv("CLIENT_ID")
-	secret := os.Getenv("CLIENT_SECRET")
 	auth := &oauth2.Config{
 		RedirectURL:  "http://localhost:3000/auth/callback",
-		ClientID:     clientId,
-		ClientSecret: secret,
+		ClientID:     config.ClientId,
+		ClientSecret: config.ClientSecret,
 		Scopes:       []string{discord.ScopeIdentify},
 		Endpoint:     discord.Endpoint,
 	}
 
-	server := NewApiService(":3000", store, auth)
-	server.Run()
+	server, err := NewApiService(config, store, auth)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := server.Run(); err != nil {
+		log.Fatal(err)
+	}
 }
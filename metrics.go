@@ -0,0 +1,169 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the request duration
+// histogram. They're prometheus' defaults.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// unmatchedRoute labels requests that no route matched, so scanners can't
+// make up a new series with every path they try
+const unmatchedRoute = "unmatched"
+
+// metrics counts what withRequestTags sees for /metrics, which writes it out
+// in the prometheus text format. It's hand rolled, as the counters and one
+// histogram here are all the service needs of a prometheus client.
+type metrics struct {
+	mu       sync.Mutex
+	requests map[requestLabels]uint64
+	latency  map[string]*histogram
+}
+
+type requestLabels struct {
+	method string
+	route  string
+	status int
+}
+
+type histogram struct {
+	// counts[i] is how many observations fell at or under latencyBuckets[i],
+	// not counting those in earlier buckets
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests: map[requestLabels]uint64{},
+		latency:  map[string]*histogram{},
+	}
+}
+
+// observe records one finished request. route is the pattern the mux
+// matched, not the path, so ids in urls don't each get their own series.
+func (m *metrics) observe(method, route string, status int, took time.Duration) {
+	if route == "" {
+		route = unmatchedRoute
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestLabels{method, route, status}]++
+
+	h, ok := m.latency[route]
+	if !ok {
+		h = &histogram{counts: make([]uint64, len(latencyBuckets))}
+		m.latency[route] = h
+	}
+	seconds := took.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+// poolStatter is a store that can report on its connection pool
+type poolStatter interface {
+	PoolStat() *pgxpool.Stat
+}
+
+// handleMetrics writes the metrics in the prometheus text format. With
+// METRICS_TOKEN set the scraper has to send it as a bearer token.
+func (s *ApiServer) handleMetrics(w http.ResponseWriter, r *http.Request) error {
+	if s.config.MetricsToken != "" {
+		given, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(s.config.MetricsToken)) != 1 {
+			return httpErrorf(http.StatusUnauthorized, "a valid metrics token is required")
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.metrics.write(w)
+	if store, ok := s.store.(poolStatter); ok {
+		writePoolStats(w, store.PoolStat())
+	}
+	return nil
+}
+
+func (m *metrics) write(w io.Writer) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	fmt.Fprintln(w, "# HELP chorse_http_requests_total Requests handled, by method, matched route and response status.")
+	fmt.Fprintln(w, "# TYPE chorse_http_requests_total counter")
+	keys := make([]requestLabels, 0, len(m.requests))
+	for key := range m.requests {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].route != keys[j].route {
+			return keys[i].route < keys[j].route
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+	for _, key := range keys {
+		fmt.Fprintf(w, "chorse_http_requests_total{method=%s,route=%s,status=\"%d\"} %d\n",
+			quoteLabel(key.method), quoteLabel(key.route), key.status, m.requests[key])
+	}
+
+	fmt.Fprintln(w, "# HELP chorse_http_request_duration_seconds Time taken to handle a request, by matched route.")
+	fmt.Fprintln(w, "# TYPE chorse_http_request_duration_seconds histogram")
+	routes := make([]string, 0, len(m.latency))
+	for route := range m.latency {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	for _, route := range routes {
+		h := m.latency[route]
+		label := quoteLabel(route)
+		// prometheus buckets are cumulative
+		var cumulative uint64
+		for i, bound := range latencyBuckets {
+			cumulative += h.counts[i]
+			fmt.Fprintf(w, "chorse_http_request_duration_seconds_bucket{route=%s,le=\"%s\"} %d\n",
+				label, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+		}
+		fmt.Fprintf(w, "chorse_http_request_duration_seconds_bucket{route=%s,le=\"+Inf\"} %d\n", label, h.count)
+		fmt.Fprintf(w, "chorse_http_request_duration_seconds_sum{route=%s} %s\n", label, strconv.FormatFloat(h.sum, 'g', -1, 64))
+		fmt.Fprintf(w, "chorse_http_request_duration_seconds_count{route=%s} %d\n", label, h.count)
+	}
+}
+
+func writePoolStats(w io.Writer, stat *pgxpool.Stat) {
+	gauges := []struct {
+		name, help string
+		value      int32
+	}{
+		{"chorse_db_pool_total_connections", "Connections in the database pool, whether idle, in use or being opened.", stat.TotalConns()},
+		{"chorse_db_pool_idle_connections", "Connections in the database pool waiting to be used.", stat.IdleConns()},
+		{"chorse_db_pool_acquired_connections", "Connections in the database pool currently in use.", stat.AcquiredConns()},
+		{"chorse_db_pool_max_connections", "Most connections the database pool will open.", stat.MaxConns()},
+	}
+	for _, g := range gauges {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", g.name, g.help, g.name, g.name, g.value)
+	}
+}
+
+// quoteLabel quotes a label value, escaping what the text format requires
+func quoteLabel(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsHistogram(t *testing.T) {
+	m := newMetrics()
+	for _, took := range []time.Duration{3 * time.Millisecond, 40 * time.Millisecond, 40 * time.Millisecond, 20 * time.Second} {
+		m.observe(http.MethodGet, "/healthz", http.StatusOK, took)
+	}
+	m.observe(http.MethodGet, "", http.StatusNotFound, time.Millisecond)
+
+	var out strings.Builder
+	m.write(&out)
+	for _, want := range []string{
+		`chorse_http_requests_total{method="GET",route="/healthz",status="200"} 4`,
+		`chorse_http_requests_total{method="GET",route="unmatched",status="404"} 1`,
+		// cumulative, and the 20s one only in +Inf
+		`chorse_http_request_duration_seconds_bucket{route="/healthz",le="0.005"} 1`,
+		`chorse_http_request_duration_seconds_bucket{route="/healthz",le="0.025"} 1`,
+		`chorse_http_request_duration_seconds_bucket{route="/healthz",le="0.05"} 3`,
+		`chorse_http_request_duration_seconds_bucket{route="/healthz",le="10"} 3`,
+		`chorse_http_request_duration_seconds_bucket{route="/healthz",le="+Inf"} 4`,
+		`chorse_http_request_duration_seconds_count{route="/healthz"} 4`,
+	} {
+		if !strings.Contains(out.String(), want+"\n") {
+			t.Errorf("missing %s in:\n%s", want, out.String())
+		}
+	}
+}
+
+func TestMetricsCountRequests(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.MetricsToken = "test-metrics-token"
+	account, token := newTestAccount(t, s, "Ada", "Lovelace")
+	other, _ := newTestAccount(t, s, "Charles", "Babbage")
+	send := func(req *http.Request) *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		s.handler().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, id := range []int{account.Id, account.Id, other.Id} {
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d", id), nil)
+		req.Header.Set("x-jwt-token", token)
+		send(req)
+	}
+
+	if rec := send(httptest.NewRequest(http.MethodGet, "/metrics", nil)); rec.Code != http.StatusUnauthorized {
+		t.Errorf("metrics without the token: status %d", rec.Code)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	req.Header.Set("Authorization", "Bearer test-metrics-token")
+	rec := send(req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	// ids share the route's series
+	for _, want := range []string{
+		`chorse_http_requests_total{method="GET",route="/account/{id}",status="200"} 2`,
+		`chorse_http_requests_total{method="GET",route="/account/{id}",status="403"} 1`,
+		`chorse_http_requests_total{method="GET",route="/metrics",status="401"} 1`,
+	} {
+		if !strings.Contains(rec.Body.String(), want+"\n") {
+			t.Errorf("missing %s in:\n%s", want, rec.Body)
+		}
+	}
+}
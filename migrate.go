@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// migration is one step in the schema's history. Init applies each one
+// once, in order, and records it in schema_migrations. A migration that has
+// shipped never changes: the schema moves on by appending new ones.
+type migration struct {
+	version     int
+	description string
+	up          func(ctx context.Context, tx pgx.Tx, defaultCurrency string) error
+}
+
+var migrations = []migration{
+	{1, "baseline schema", baselineSchema},
+	{2, "account external ids", addAccountExternalId},
+	{3, "discord user sign out", addDiscordUserSignedOutAt},
+	{4, "sandbox accounts", addAccountIsSandbox},
+	{5, "discord user deactivation", addDiscordUserDeactivatedAt},
+	{6, "account versions", addAccountVersion},
+	{7, "account emails", addAccountEmail},
+	{8, "bigint balances", widenBalances},
+}
+
+// baselineSchema is everything from before migrations were versioned. Each
+// step checks what's already there, so it also brings databases made by
+// older versions (or from sql/tables.sql) up to date.
+func baselineSchema(ctx context.Context, tx pgx.Tx, defaultCurrency string) error {
+	if err := createAccountTable(ctx, tx); err != nil {
+		return err
+	}
+	if err := alterAccountTable(ctx, tx, defaultCurrency); err != nil {
+		return err
+	}
+	if err := createTransferTable(ctx, tx); err != nil {
+		return err
+	}
+	if err := createTransactionTable(ctx, tx); err != nil {
+		return err
+	}
+	if err := createArchivedTransactionTable(ctx, tx); err != nil {
+		return err
+	}
+	if err := createDiscordUserTable(ctx, tx); err != nil {
+		return err
+	}
+	if err := createBalanceSnapshotTable(ctx, tx); err != nil {
+		return err
+	}
+	return createTransferWhitelistTable(ctx, tx)
+}
+
+// addAccountExternalId lets imports name accounts by their own key, so a
+// re-run import finds the accounts it already made
+func addAccountExternalId(ctx context.Context, tx pgx.Tx, _ string) error {
+	if _, err := tx.Exec(ctx, "alter table account add column external_id text"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "create unique index account_external_id_key on account (external_id)")
+	return err
+}
+
+// addDiscordUserSignedOutAt records when a user last logged out. Session
+// cookies issued before then stop working, see withSession.
+func addDiscordUserSignedOutAt(ctx context.Context, tx pgx.Tx, _ string) error {
+	_, err := tx.Exec(ctx, "alter table discord_user add column signed_out_at timestamptz")
+	return err
+}
+
+// addAccountIsSandbox marks the accounts made for testing, which the
+// reports and reconciliation leave out unless asked
+func addAccountIsSandbox(ctx context.Context, tx pgx.Tx, _ string) error {
+	_, err := tx.Exec(ctx, "alter table account add column is_sandbox boolean not null default false")
+	return err
+}
+
+// addDiscordUserDeactivatedAt records when an inactive user was cleaned up
+func addDiscordUserDeactivatedAt(ctx context.Context, tx pgx.Tx, _ string) error {
+	_, err := tx.Exec(ctx, "alter table discord_user add column deactivated_at timestamptz")
+	return err
+}
+
+// addAccountVersion numbers each account's writes, so a client can tell
+// when its copy has gone stale. The updated_at trigger bumps it, so it
+// counts the same writes updated_at does.
+func addAccountVersion(ctx context.Context, tx pgx.Tx, _ string) error {
+	if _, err := tx.Exec(ctx, "alter table account add column version bigint not null default 1"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, `
+		create or replace function account_touch_updated_at() returns trigger as $$
+		begin
+			new.updated_at = now();
+			new.version = old.version + 1;
+			return new;
+		end
+		$$ language plpgsql`)
+	return err
+}
+
+// addAccountEmail gives accounts an address for the notifier to mail
+func addAccountEmail(ctx context.Context, tx pgx.Tx, _ string) error {
+	_, err := tx.Exec(ctx, "alter table account add column email text")
+	return err
+}
+
+// widenBalances makes room for balances and transfers past the int column
+// limit, about $21.4M now that amounts are counted in cents
+func widenBalances(ctx context.Context, tx pgx.Tx, _ string) error {
+	if _, err := tx.Exec(ctx, "alter table account alter column balance type bigint"); err != nil {
+		return err
+	}
+	_, err := tx.Exec(ctx, "alter table transfer alter column amount type bigint")
+	return err
+}
+
+// Init brings the schema up to date by applying the migrations that haven't
+// been yet, so it's safe to run on every start. Accounts from before
+// currencies were recorded are put in defaultCurrency.
+func (s *PostgresStore) Init(ctx context.Context, defaultCurrency string) error {
+	_, err := s.db.Exec(ctx, `
+		create table if not exists schema_migrations
+		( version int primary key
+		, description text
+		, applied_at timestamptz default (now() at time zone 'utc')
+		)`)
+	if err != nil {
+		return err
+	}
+	for _, m := range migrations {
+		if err := s.applyMigration(ctx, m, defaultCurrency); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.description, err)
+		}
+	}
+	return nil
+}
+
+// applyMigration runs m and records it in one transaction, or does nothing
+// if it's been applied already
+func (s *PostgresStore) applyMigration(ctx context.Context, m migration, defaultCurrency string) error {
+	tx, err := s.db.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// two instances starting at once would otherwise both see m as pending
+	if _, err := tx.Exec(ctx, "lock table schema_migrations in exclusive mode"); err != nil {
+		return err
+	}
+	var applied bool
+	err = tx.QueryRow(ctx, "select exists (select 1 from schema_migrations where version = $1)", m.version).Scan(&applied)
+	if err != nil || applied {
+		return err
+	}
+
+	if err := m.up(ctx, tx, defaultCurrency); err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, "insert into schema_migrations (version, description) values ($1, $2)", m.version, m.description)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
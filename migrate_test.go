@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"math"
+	"slices"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+)
+
+func TestMigrationsAreNumberedInOrder(t *testing.T) {
+	for i, m := range migrations {
+		if m.version != i+1 {
+			t.Errorf("migration %d (%s) is at position %d", m.version, m.description, i+1)
+		}
+		if m.description == "" || m.up == nil {
+			t.Errorf("migration %d is incomplete", m.version)
+		}
+	}
+}
+
+func TestBalancesPastInt32(t *testing.T) {
+	store := newTestPostgresStore(t)
+	ctx := context.Background()
+	from, to := seedAccount(t, store, math.MaxInt32), seedAccount(t, store, 0)
+
+	balance, err := store.Deposit(ctx, from.Id, math.MaxInt32, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 2*math.MaxInt32 {
+		t.Fatalf("balance %d, want %d", balance, 2*math.MaxInt32)
+	}
+	if _, err := store.Transfer(ctx, from.Id, to.Id, math.MaxInt32+1, FeeCharge{}, nil); err != nil {
+		t.Fatal(err)
+	}
+	got, err := store.GetAccountById(ctx, to.Id)
+	if err != nil || got.Balance != math.MaxInt32+1 {
+		t.Errorf("recipient got %+v, %v, want a balance of %d", got, err, int64(math.MaxInt32+1))
+	}
+}
+
+func TestInitIsIdempotent(t *testing.T) {
+	store := newTestPostgresStore(t)
+	ctx := context.Background()
+	account := seedAccount(t, store, 250)
+
+	// newTestPostgresStore ran it once already
+	for i := 0; i < 2; i++ {
+		if err := store.Init(ctx, "USD"); err != nil {
+			t.Fatalf("init %d: %v", i+2, err)
+		}
+	}
+
+	rows, err := store.db.Query(ctx, "select version from schema_migrations order by version")
+	if err != nil {
+		t.Fatal(err)
+	}
+	applied, err := pgx.CollectRows(rows, pgx.RowTo[int])
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want []int
+	for _, m := range migrations {
+		want = append(want, m.version)
+	}
+	if !slices.Equal(applied, want) {
+		t.Errorf("applied %v, want each of %v once", applied, want)
+	}
+
+	got, err := store.GetAccountById(ctx, account.Id)
+	if err != nil || got == nil || got.Balance != 250 {
+		t.Errorf("after re-running init got %+v, %v", got, err)
+	}
+}
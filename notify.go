@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+const EventLowBalance = "balance.low"
+
+// Event is something that happened to an account that its owner may want
+// to hear about.
+type Event struct {
+	Kind      string `json:"kind"`
+	AccountId int    `json:"accountId"`
+	Number    int64  `json:"number"`
+	Balance   int64  `json:"balance"`
+	Threshold int64  `json:"threshold,omitempty"`
+	// Link is for the owner to follow, e.g. to verify their email. It's a
+	// path on this site, and for a verification link as good as a password.
+	Link string `json:"link,omitempty"`
+	// Email is the owner's address, if the account has one
+	Email string `json:"-"`
+}
+
+type Notifier interface {
+	Notify(context.Context, Event) error
+}
+
+// newNotifier mails events when SMTP_ADDR is set, and otherwise only logs
+// them
+func newNotifier(config *Config, logger *slog.Logger) Notifier {
+	if config.SmtpAddr == "" {
+		return logNotifier{logger: logger}
+	}
+	return newSmtpNotifier(config, logger)
+}
+
+// logNotifier just logs events, for running without a mail server. The link
+// is left out, since anyone who can read the logs could follow it.
+type logNotifier struct {
+	logger *slog.Logger
+}
+
+func (n logNotifier) Notify(ctx context.Context, event Event) error {
+	n.logger.InfoContext(ctx, "account event",
+		"kind", event.Kind,
+		"account_id", event.AccountId,
+		"balance", event.Balance,
+		"threshold", event.Threshold,
+		"has_link", event.Link != "",
+	)
+	return nil
+}
+
+// smtpNotifier mails events to the account's owner. Events for accounts
+// without an email address have nowhere to go and are dropped.
+type smtpNotifier struct {
+	addr    string
+	auth    smtp.Auth
+	from    string
+	siteUrl string
+	logger  *slog.Logger
+	// send is smtp.SendMail, swapped out in tests
+	send func(addr string, a smtp.Auth, from string, to []string, msg []byte) error
+}
+
+func newSmtpNotifier(config *Config, logger *slog.Logger) *smtpNotifier {
+	n := &smtpNotifier{
+		addr:    config.SmtpAddr,
+		from:    config.SmtpFrom,
+		siteUrl: strings.TrimSuffix(config.PublicUrl, "/"),
+		logger:  logger,
+		send:    smtp.SendMail,
+	}
+	if config.SmtpUsername != "" {
+		host, _, _ := net.SplitHostPort(config.SmtpAddr)
+		n.auth = smtp.PlainAuth("", config.SmtpUsername, config.SmtpPassword, host)
+	}
+	return n
+}
+
+func (n *smtpNotifier) Notify(ctx context.Context, event Event) error {
+	if event.Email == "" {
+		n.logger.DebugContext(ctx, "no email to send event to", "kind", event.Kind, "account_id", event.AccountId)
+		return nil
+	}
+	subject, body := n.compose(event)
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\nContent-Type: text/plain; charset=utf-8\r\n\r\n%s\r\n",
+		n.from, event.Email, subject, body)
+	if err := n.send(n.addr, n.auth, n.from, []string{event.Email}, []byte(msg)); err != nil {
+		return fmt.Errorf("mailing %s event: %w", event.Kind, err)
+	}
+	return nil
+}
+
+// compose writes the subject and body of the mail for event
+func (n *smtpNotifier) compose(event Event) (string, string) {
+	switch event.Kind {
+	case EventVerifyEmail:
+		return "Verify your email",
+			"Follow this link to verify the email address on your account:\r\n\r\n" + n.siteUrl + event.Link
+	case EventLowBalance:
+		return "Your balance is running low",
+			fmt.Sprintf("The balance of account %d has dropped below the low balance threshold you set.", event.Number)
+	default:
+		return "Account update", fmt.Sprintf("Something happened on your account: %s.", event.Kind)
+	}
+}
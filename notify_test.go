@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net/smtp"
+	"strings"
+	"testing"
+)
+
+func TestSmtpNotifierMailsVerificationLink(t *testing.T) {
+	n := newSmtpNotifier(&Config{SmtpAddr: "mail.test:25", SmtpFrom: "bank@chorse.test", PublicUrl: "https://chorse.test/"}, slog.Default())
+	var to []string
+	var msg string
+	n.send = func(addr string, a smtp.Auth, from string, recipients []string, body []byte) error {
+		to, msg = recipients, string(body)
+		return nil
+	}
+
+	err := n.Notify(context.Background(), Event{Kind: EventVerifyEmail, AccountId: 1, Link: "/verify-email?token=abc", Email: "ada@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(to) != 1 || to[0] != "ada@example.com" {
+		t.Errorf("mailed %v, want ada@example.com", to)
+	}
+	if !strings.Contains(msg, "https://chorse.test/verify-email?token=abc") {
+		t.Errorf("mail is missing the absolute link:\n%s", msg)
+	}
+}
+
+func TestSmtpNotifierSkipsAccountsWithoutEmail(t *testing.T) {
+	n := newSmtpNotifier(&Config{SmtpAddr: "mail.test:25", SmtpFrom: "bank@chorse.test"}, slog.Default())
+	n.send = func(string, smtp.Auth, string, []string, []byte) error {
+		t.Fatal("mailed an event with no address")
+		return nil
+	}
+	if err := n.Notify(context.Background(), Event{Kind: EventLowBalance, AccountId: 1}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLogNotifierLeavesOutLink(t *testing.T) {
+	var logs bytes.Buffer
+	n := logNotifier{logger: slog.New(slog.NewTextHandler(&logs, nil))}
+	if err := n.Notify(context.Background(), Event{Kind: EventVerifyEmail, Link: "/verify-email?token=secret"}); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(logs.String(), "secret") {
+		t.Errorf("verification link was logged: %s", logs.String())
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// oauthStateTtl is how long a user has to finish logging in with discord
+const oauthStateTtl = 10 * time.Minute
+
+const oauthStateCookie = "oauth_state"
+
+// issueOAuthState makes a random state for a login url and hands it to the
+// browser in a signed, short lived cookie, so the callback can check the
+// state it gets back came from a login this browser started.
+func (s *ApiServer) issueOAuthState(w http.ResponseWriter, r *http.Request) (string, error) {
+	if len(s.config.JwtSecrets) == 0 {
+		return "", ErrNoJwtSecret
+	}
+	state := newRequestId()
+	expires := time.Now().Add(oauthStateTtl).Unix()
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     oauthStateCookie,
+		Value:    fmt.Sprintf("%s.%d.%s", state, expires, signOAuthState(s.config.JwtSecrets[0], state, expires)),
+		Path:     "/auth/callback",
+		MaxAge:   int(oauthStateTtl.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		// lax still sends it on discord's top level redirect back to us
+		SameSite: http.SameSiteLaxMode,
+	})
+	return state, nil
+}
+
+// checkOAuthState reports whether the callback's state matches an unexpired
+// cookie we signed. The cookie is cleared either way so it works once.
+func (s *ApiServer) checkOAuthState(w http.ResponseWriter, r *http.Request) bool {
+	cookie, err := r.Cookie(oauthStateCookie)
+	if err != nil {
+		return false
+	}
+	http.SetCookie(w, &http.Cookie{Name: oauthStateCookie, Path: "/auth/callback", MaxAge: -1})
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return false
+	}
+	state, mac := parts[0], parts[2]
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(state), []byte(r.FormValue("state"))) != 1 {
+		return false
+	}
+
+	// any configured secret will do, so a rotation doesn't break logins in progress
+	for _, secret := range s.config.JwtSecrets {
+		if hmac.Equal([]byte(mac), []byte(signOAuthState(secret, state, expires))) {
+			return true
+		}
+	}
+	return false
+}
+
+func signOAuthState(secret, state string, expires int64) string {
+	// the prefix keeps these macs from ever passing for anything else signed
+	// with the same secret
+	h := hmac.New(sha256.New, []byte("oauth-state:"+secret))
+	fmt.Fprintf(h, "%s.%d", state, expires)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCheckOAuthState(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	issued := httptest.NewRecorder()
+	state, err := s.issueOAuthState(issued, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookie := issued.Result().Cookies()[0]
+
+	expired := time.Now().Add(-time.Minute).Unix()
+	tests := map[string]struct {
+		state  string
+		cookie *http.Cookie
+		want   bool
+	}{
+		"round trip":       {state, cookie, true},
+		"no cookie":        {state, nil, false},
+		"other state":      {"randomstate", cookie, false},
+		"forged signature": {"forged", &http.Cookie{Name: oauthStateCookie, Value: fmt.Sprintf("forged.%d.%s", time.Now().Add(time.Minute).Unix(), "00")}, false},
+		"expired":          {"old", &http.Cookie{Name: oauthStateCookie, Value: fmt.Sprintf("old.%d.%s", expired, signOAuthState(s.config.JwtSecrets[0], "old", expired))}, false},
+	}
+	for name, test := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/auth/callback?state="+test.state, nil)
+		if test.cookie != nil {
+			req.AddCookie(test.cookie)
+		}
+		rec := httptest.NewRecorder()
+		if got := s.checkOAuthState(rec, req); got != test.want {
+			t.Errorf("%s: got %v, want %v", name, got, test.want)
+		}
+		if test.cookie != nil && rec.Result().Cookies()[0].MaxAge >= 0 {
+			t.Errorf("%s: state cookie wasn't cleared", name)
+		}
+	}
+}
+
+func TestAuthCallbackRejectsForgedState(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?code=test-code&state=randomstate", nil)
+	rec := httptest.NewRecorder()
+	s.handleAuthCallback(rec, req)
+	if rec.Code != http.StatusBadRequest {
+		t.Errorf("status %d, want 400", rec.Code)
+	}
+}
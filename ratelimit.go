@@ -0,0 +1,125 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimitIdle is how long a bucket goes unused before cleanup drops it. A
+// dropped bucket comes back full, so this has to be longer than it takes
+// an empty one to refill.
+const rateLimitIdle = 10 * time.Minute
+
+type tokenBucket struct {
+	tokens   float64
+	lastSeen time.Time
+}
+
+// rateLimiter is a token bucket per client ip, kept in memory. Each bucket
+// holds up to burst tokens and refills at rate a second; a request takes one.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+	now   func() time.Time
+
+	mu      sync.Mutex
+	buckets map[string]*tokenBucket
+
+	stop chan struct{}
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	return &rateLimiter{
+		rate:    rate,
+		burst:   float64(burst),
+		now:     time.Now,
+		buckets: map[string]*tokenBucket{},
+		stop:    make(chan struct{}),
+	}
+}
+
+// Allow takes a token from key's bucket. When there isn't one it returns
+// false and how long until there will be.
+func (l *rateLimiter) Allow(key string) (bool, time.Duration) {
+	now := l.now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.burst}
+		l.buckets[key] = bucket
+	} else {
+		bucket.tokens = math.Min(l.burst, bucket.tokens+now.Sub(bucket.lastSeen).Seconds()*l.rate)
+	}
+	bucket.lastSeen = now
+
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / l.rate * float64(time.Second))
+	return false, wait
+}
+
+// run drops idle buckets every minute until Close is called
+func (l *rateLimiter) run() {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			l.cleanup()
+		case <-l.stop:
+			return
+		}
+	}
+}
+
+func (l *rateLimiter) cleanup() {
+	cutoff := l.now().Add(-rateLimitIdle)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, bucket := range l.buckets {
+		if bucket.lastSeen.Before(cutoff) {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func (l *rateLimiter) Close() {
+	close(l.stop)
+}
+
+// withRateLimit answers clients over the limiter's rate with 429. With
+// methods given only those are limited, so e.g. creating accounts can be
+// limited without limiting listing them.
+func withRateLimit(limiter *rateLimiter, handlerFunc http.HandlerFunc, methods ...string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(methods) > 0 && !slices.Contains(methods, r.Method) {
+			handlerFunc(w, r)
+			return
+		}
+		if ok, wait := limiter.Allow(clientIp(r)); !ok {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+			WriteJson(w, http.StatusTooManyRequests, newApiError(CodeRateLimited, "too many requests, try again later"))
+			return
+		}
+		handlerFunc(w, r)
+	}
+}
+
+// clientIp is the address the request came from. Forwarding headers aren't
+// trusted since any client can set them.
+func clientIp(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterRefills(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	l := newRateLimiter(1, 2)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("10.0.0.1"); !ok {
+			t.Fatalf("request %d within the burst was refused", i+1)
+		}
+	}
+	ok, wait := l.Allow("10.0.0.1")
+	if ok || wait != time.Second {
+		t.Fatalf("over the burst: got %v, wait %v, want refused for 1s", ok, wait)
+	}
+	if ok, _ := l.Allow("10.0.0.2"); !ok {
+		t.Error("another ip shares the bucket")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("10.0.0.1"); !ok {
+		t.Error("refused after refilling a token")
+	}
+	if ok, _ := l.Allow("10.0.0.1"); ok {
+		t.Error("refilled more than the time allows")
+	}
+
+	now = now.Add(rateLimitIdle + time.Second)
+	l.cleanup()
+	if len(l.buckets) != 0 {
+		t.Errorf("%d idle buckets kept", len(l.buckets))
+	}
+}
+
+func TestAccountCreationIsRateLimited(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.authLimiter = newRateLimiter(1, 1)
+	create := func() *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName":"Ada","lastName":"Lovelace"}`))
+		return serve(s, req, "")
+	}
+
+	if rec := create(); rec.Code != http.StatusOK {
+		t.Fatalf("first create: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := create()
+	wantApiError(t, rec, http.StatusTooManyRequests, CodeRateLimited)
+	if rec.Header().Get("Retry-After") != "1" {
+		t.Errorf("Retry-After is %q, want 1", rec.Header().Get("Retry-After"))
+	}
+
+	// only creating is limited
+	_, token := newTestAccount(t, s, "Charles", "Babbage")
+	req := httptest.NewRequest(http.MethodGet, "/account", nil)
+	req.Header.Set("x-admin-token", s.config.AdminToken)
+	if rec := serve(s, req, token); rec.Code == http.StatusTooManyRequests {
+		t.Error("listing accounts was rate limited")
+	}
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// sessionTtl is how long a discord login lasts before the user has to go
+// through oauth again
+const sessionTtl = 7 * 24 * time.Hour
+
+const sessionCookie = "session"
+
+var ErrNoSession = errors.New("not signed in")
+
+// issueSession signs the browser in as the discord user with an HttpOnly
+// cookie holding their id, when it expires and a mac over both. It returns
+// the session's correlation id.
+func (s *ApiServer) issueSession(w http.ResponseWriter, r *http.Request, discordId string) (string, error) {
+	if len(s.config.JwtSecrets) == 0 {
+		return "", ErrNoJwtSecret
+	}
+	expires := time.Now().Add(sessionTtl).Unix()
+	mac := signSession(s.config.JwtSecrets[0], discordId, expires)
+	s.setAuthCookie(w, r, fmt.Sprintf("%s.%d.%s", discordId, expires, mac))
+	return correlationId(mac), nil
+}
+
+// setAuthCookie sets the session cookie. Every sign in goes through here so
+// the cookie always has the same attributes, and so clearAuthCookie always
+// matches it.
+func (s *ApiServer) setAuthCookie(w http.ResponseWriter, r *http.Request, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Value:    value,
+		Path:     "/",
+		MaxAge:   int(sessionTtl.Seconds()),
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// clearAuthCookie signs the browser out
+func (s *ApiServer) clearAuthCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookie,
+		Path:     "/",
+		MaxAge:   -1,
+		HttpOnly: true,
+		Secure:   s.secureCookies(r),
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// secureCookies says whether cookies should be https only. Production always
+// is, since tls is usually ended at a proxy and never seen here; dev only
+// when it's being served over tls directly.
+func (s *ApiServer) secureCookies(r *http.Request) bool {
+	return s.config.Environment == EnvProd || r.TLS != nil
+}
+
+// readSession returns the discord id of the signed in user and when their
+// session began, or ErrNoSession if the cookie is missing, expired or
+// wasn't signed by us. It doesn't check for a logout since, see withSession.
+func (s *ApiServer) readSession(r *http.Request) (string, time.Time, error) {
+	discordId, _, expires, err := s.parseSession(r)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	// cookies only carry their expiry, to the second
+	return discordId, time.Unix(expires, 0).Add(-sessionTtl), nil
+}
+
+// sessionCorrelationId is the correlation id of the request's session, or
+// "" without a valid one
+func (s *ApiServer) sessionCorrelationId(r *http.Request) string {
+	_, mac, _, err := s.parseSession(r)
+	if err != nil {
+		return ""
+	}
+	return correlationId(mac)
+}
+
+func (s *ApiServer) parseSession(r *http.Request) (discordId, mac string, expires int64, err error) {
+	cookie, err := r.Cookie(sessionCookie)
+	if err != nil {
+		return "", "", 0, ErrNoSession
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	if len(parts) != 3 {
+		return "", "", 0, ErrNoSession
+	}
+	discordId, mac = parts[0], parts[2]
+	expires, err = strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().Unix() > expires {
+		return "", "", 0, ErrNoSession
+	}
+
+	for _, secret := range s.config.JwtSecrets {
+		if hmac.Equal([]byte(mac), []byte(signSession(secret, discordId, expires))) {
+			return discordId, mac, expires, nil
+		}
+	}
+	return "", "", 0, ErrNoSession
+}
+
+// correlationId ties together the log lines of one login session, from the
+// oauth callback on. It's derived from the session's mac so it needs no
+// storage, and hashed so the logs never hold anything that could be turned
+// back into a cookie.
+func correlationId(mac string) string {
+	sum := sha256.Sum256([]byte("correlation:" + mac))
+	return hex.EncodeToString(sum[:8])
+}
+
+// withSession lets through requests from a signed in browser, with the
+// discord id on the context for sessionUser, and answers the rest with 401.
+// A cookie from before the user last logged out is refused, so logging out
+// ends copies of the session too and not just the browser's. Cookies only
+// know when they were issued to the second, so the logout is rounded down to
+// match: one issued the same second still works, or logging straight back in
+// would give a cookie that's already refused.
+func (s *ApiServer) withSession(handlerFunc http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		discordId, issuedAt, err := s.readSession(r)
+		if err != nil {
+			WriteJson(w, http.StatusUnauthorized, newApiError(CodeNotSignedIn, err.Error()))
+			return
+		}
+		user, err := s.store.GetDiscordUser(r.Context(), discordId)
+		if err != nil {
+			WriteJson(w, http.StatusInternalServerError, newApiError(CodeInternal, "could not check session"))
+			return
+		}
+		if user != nil && user.SignedOutAt != nil && issuedAt.Before(user.SignedOutAt.Truncate(time.Second)) {
+			WriteJson(w, http.StatusUnauthorized, newApiError(CodeNotSignedIn, ErrNoSession.Error()))
+			return
+		}
+		handlerFunc(w, r.WithContext(context.WithValue(r.Context(), sessionUserKey{}, discordId)))
+	}
+}
+
+type sessionUserKey struct{}
+
+// sessionUser is the discord id of the user whose session got the request
+// through withSession
+func sessionUser(r *http.Request) string {
+	discordId, _ := r.Context().Value(sessionUserKey{}).(string)
+	return discordId
+}
+
+func signSession(secret, discordId string, expires int64) string {
+	// prefixed like the oauth state so neither mac can stand in for the other
+	h := hmac.New(sha256.New, []byte("session:"+secret))
+	fmt.Fprintf(h, "%s.%d", discordId, expires)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/oauth2"
+)
+
+// sessionCookieFor signs the user in on a throwaway recorder and returns the
+// cookie they were given
+func sessionCookieFor(t *testing.T, s *ApiServer, discordId string) *http.Cookie {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	if _, err := s.issueSession(rec, httptest.NewRequest(http.MethodGet, "/auth/callback", nil), discordId); err != nil {
+		t.Fatal(err)
+	}
+	for _, cookie := range rec.Result().Cookies() {
+		if cookie.Name == sessionCookie {
+			return cookie
+		}
+	}
+	t.Fatal("no session cookie set")
+	return nil
+}
+
+func TestReadSession(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	cookie := sessionCookieFor(t, s, "80351110224678912")
+	read := func(value string) (string, error) {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.AddCookie(&http.Cookie{Name: sessionCookie, Value: value})
+		discordId, _, err := s.readSession(req)
+		return discordId, err
+	}
+
+	if discordId, err := read(cookie.Value); err != nil || discordId != "80351110224678912" {
+		t.Fatalf("got %q, %v, want the signed in user", discordId, err)
+	}
+
+	parts := strings.Split(cookie.Value, ".")
+	for name, value := range map[string]string{
+		"other user":      "1." + parts[1] + "." + parts[2],
+		"longer expiry":   parts[0] + ".9999999999." + parts[2],
+		"mac changed":     parts[0] + "." + parts[1] + "." + strings.Repeat("0", len(parts[2])),
+		"missing mac":     parts[0] + "." + parts[1],
+		"not a timestamp": parts[0] + ".soon." + parts[2],
+	} {
+		if discordId, err := read(value); err != ErrNoSession {
+			t.Errorf("%s: got %q, %v, want ErrNoSession", name, discordId, err)
+		}
+	}
+
+	s.config.JwtSecrets = []string{"a-different-secret-that-is-long-enough"}
+	if _, err := read(cookie.Value); err != ErrNoSession {
+		t.Errorf("cookie signed with an unknown secret: err = %v", err)
+	}
+}
+
+func TestAuthCookieAttributes(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	for _, test := range []struct {
+		env    string
+		tls    bool
+		secure bool
+	}{
+		{EnvProd, false, true},
+		{EnvDev, false, false},
+		{EnvDev, true, true},
+	} {
+		s.config.Environment = test.env
+		target := "http://chorse.test/auth/callback"
+		if test.tls {
+			target = "https://chorse.test/auth/callback"
+		}
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		set := httptest.NewRecorder()
+		s.setAuthCookie(set, req, "value")
+		cleared := httptest.NewRecorder()
+		s.clearAuthCookie(cleared, req)
+
+		for name, rec := range map[string]*httptest.ResponseRecorder{"set": set, "cleared": cleared} {
+			cookie := rec.Result().Cookies()[0]
+			if cookie.Name != sessionCookie || cookie.Path != "/" || !cookie.HttpOnly || cookie.SameSite != http.SameSiteLaxMode {
+				t.Errorf("%s, tls %v, %s: got %+v", test.env, test.tls, name, cookie)
+			}
+			if cookie.Secure != test.secure {
+				t.Errorf("%s, tls %v, %s: secure is %v, want %v", test.env, test.tls, name, cookie.Secure, test.secure)
+			}
+		}
+		if age := cleared.Result().Cookies()[0].MaxAge; age >= 0 {
+			t.Errorf("%s: cleared cookie has max age %d", test.env, age)
+		}
+	}
+}
+
+func TestLoginAndCreateShareCorrelationId(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.auth.Endpoint = oauth2.Endpoint{TokenURL: "https://discord.test/api/oauth2/token"}
+	var logs bytes.Buffer
+	s.logger = slog.New(requestIdHandler{slog.NewJSONHandler(&logs, nil)})
+
+	stateRec := httptest.NewRecorder()
+	state, err := s.issueOAuthState(stateRec, httptest.NewRequest(http.MethodGet, "/login", nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/auth/callback?code=test-code&state="+state, nil)
+	for _, cookie := range stateRec.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	client := &http.Client{Transport: stubDiscord{`{"id":"80351110224678912","global_name":"Nelly"}`}}
+	login := httptest.NewRecorder()
+	s.handler().ServeHTTP(login, req.WithContext(context.WithValue(req.Context(), oauth2.HTTPClient, client)))
+	if login.Code != http.StatusFound {
+		t.Fatalf("callback status %d: %s", login.Code, login.Body)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "/account", strings.NewReader(`{"firstName":"Ada","lastName":"Lovelace"}`))
+	for _, cookie := range login.Result().Cookies() {
+		req.AddCookie(cookie)
+	}
+	create := httptest.NewRecorder()
+	s.handler().ServeHTTP(create, req)
+	if create.Code != http.StatusOK {
+		t.Fatalf("create status %d: %s", create.Code, create.Body)
+	}
+
+	ids := map[string]string{}
+	for _, line := range strings.Split(strings.TrimSpace(logs.String()), "\n") {
+		var entry struct {
+			Msg           string `json:"msg"`
+			CorrelationId string `json:"correlation_id"`
+		}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("%v: %s", err, line)
+		}
+		ids[entry.Msg] = entry.CorrelationId
+	}
+	if ids["signed in"] == "" || ids["created account"] != ids["signed in"] {
+		t.Errorf("signed in as %q, created account as %q, want the same id:\n%s", ids["signed in"], ids["created account"], logs.String())
+	}
+}
+
+func TestLoginRightAfterLogout(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	if _, err := s.store.UpsertDiscordUser(context.Background(), &DiscordUser{Id: "80351110224678912", GlobalName: "Nelly"}); err != nil {
+		t.Fatal(err)
+	}
+	me := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/me", nil)
+		req.AddCookie(cookie)
+		return serve(s, req, "")
+	}
+
+	logout := httptest.NewRequest(http.MethodPost, "/logout", nil)
+	logout.AddCookie(sessionCookieFor(t, s, "80351110224678912"))
+	if rec := serve(s, logout, ""); rec.Code != http.StatusOK {
+		t.Fatalf("logout: status %d: %s", rec.Code, rec.Body)
+	}
+	// most likely within the same second as the logout
+	if rec := me(sessionCookieFor(t, s, "80351110224678912")); rec.Code != http.StatusOK {
+		t.Errorf("new session right after logout: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestMeFallsBackToDefaultAvatar(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	user := &DiscordUser{Id: "80351110224678912", GlobalName: "Nelly", Avatar: "8342729096ea3675442027381ff50dfe"}
+	if _, err := s.store.UpsertDiscordUser(context.Background(), user); err != nil {
+		t.Fatal(err)
+	}
+	cdn := httptest.NewServer(http.NotFoundHandler())
+	t.Cleanup(cdn.Close)
+	s.avatars.baseURL = cdn.URL
+
+	req := httptest.NewRequest(http.MethodGet, "/me", nil)
+	req.AddCookie(sessionCookieFor(t, s, user.Id))
+	rec := serve(s, req, "")
+	var me struct {
+		AvatarUrl string `json:"avatarUrl"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &me); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+	if want := defaultAvatarURL(cdn.URL, user.Id); me.AvatarUrl != want {
+		t.Errorf("avatarUrl is %q, want the default %q", me.AvatarUrl, want)
+	}
+}
+
+func TestLogoutEndsSession(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	if _, err := s.store.UpsertDiscordUser(context.Background(), &DiscordUser{Id: "80351110224678912", GlobalName: "Nelly"}); err != nil {
+		t.Fatal(err)
+	}
+	// issued a second back, so the logout below is strictly after it
+	expires := time.Now().Add(sessionTtl - time.Second).Unix()
+	cookie := &http.Cookie{
+		Name:  sessionCookie,
+		Value: fmt.Sprintf("80351110224678912.%d.%s", expires, signSession(s.config.JwtSecrets[0], "80351110224678912", expires)),
+	}
+	withCookie := func(method, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		req.AddCookie(cookie)
+		return serve(s, req, "")
+	}
+
+	if rec := withCookie(http.MethodGet, "/me"); rec.Code != http.StatusOK {
+		t.Fatalf("before logout: status %d: %s", rec.Code, rec.Body)
+	}
+	rec := withCookie(http.MethodPost, "/logout")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("logout: status %d: %s", rec.Code, rec.Body)
+	}
+	if cleared := rec.Result().Cookies(); len(cleared) != 1 || cleared[0].Name != sessionCookie || cleared[0].MaxAge >= 0 {
+		t.Errorf("session cookie wasn't cleared: %+v", cleared)
+	}
+
+	// a copy of the cookie kept from before doesn't work either
+	wantApiError(t, withCookie(http.MethodGet, "/me"), http.StatusUnauthorized, CodeNotSignedIn)
+
+	// and logging out again is fine
+	if rec := serve(s, httptest.NewRequest(http.MethodPost, "/logout", nil), ""); rec.Code != http.StatusOK {
+		t.Errorf("logout when signed out: status %d: %s", rec.Code, rec.Body)
+	}
+}
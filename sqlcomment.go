@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// queryTags describe the request a query is run for, so DBAs can line up
+// postgres logs with our own.
+type queryTags struct {
+	RequestId string
+	Route     string
+	// CorrelationId is the browser session's, see correlationId. Only the
+	// logs carry it.
+	CorrelationId string
+}
+
+type queryTagsKey struct{}
+
+func withQueryTags(ctx context.Context, tags queryTags) context.Context {
+	return context.WithValue(ctx, queryTagsKey{}, tags)
+}
+
+// sqlComment builds a sqlcommenter style comment from the tags on ctx.
+// Values are url encoded, so nothing from a request can close the comment.
+func sqlComment(ctx context.Context) string {
+	tags, ok := ctx.Value(queryTagsKey{}).(queryTags)
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf("/* request_id='%s',route='%s' */ ",
+		url.QueryEscape(tags.RequestId), url.QueryEscape(tags.Route))
+}
+
+// commentingPool prepends the request's sqlComment to every query when
+// enabled. Since every request's sql is then unique, the pool must not use
+// the statement cache (see newCommentingPool) or it would fill up with
+// single use statements and evict the useful ones.
+type commentingPool struct {
+	*pgxpool.Pool
+	enabled bool
+}
+
+func newCommentingPool(ctx context.Context, conStr string, enabled bool) (*commentingPool, error) {
+	config, err := pgxpool.ParseConfig(conStr)
+	if err != nil {
+		return nil, err
+	}
+	if enabled {
+		config.ConnConfig.DefaultQueryExecMode = pgx.QueryExecModeDescribeExec
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	return &commentingPool{Pool: pool, enabled: enabled}, nil
+}
+
+func (p *commentingPool) annotate(ctx context.Context, sql string) string {
+	return annotate(ctx, p.enabled, sql)
+}
+
+func annotate(ctx context.Context, enabled bool, sql string) string {
+	if !enabled {
+		return sql
+	}
+	return sqlComment(ctx) + sql
+}
+
+func (p *commentingPool) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return p.Pool.Exec(ctx, p.annotate(ctx, sql), args...)
+}
+
+func (p *commentingPool) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return p.Pool.Query(ctx, p.annotate(ctx, sql), args...)
+}
+
+func (p *commentingPool) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return p.Pool.QueryRow(ctx, p.annotate(ctx, sql), args...)
+}
+
+func (p *commentingPool) Begin(ctx context.Context) (pgx.Tx, error) {
+	return p.BeginTx(ctx, pgx.TxOptions{})
+}
+
+func (p *commentingPool) BeginTx(ctx context.Context, opts pgx.TxOptions) (pgx.Tx, error) {
+	tx, err := p.Pool.BeginTx(ctx, opts)
+	if err != nil {
+		return nil, err
+	}
+	return &commentingTx{Tx: tx, enabled: p.enabled}, nil
+}
+
+// commentingTx is a transaction begun on a commentingPool, so queries in
+// transactions (and their savepoints) are tagged too.
+type commentingTx struct {
+	pgx.Tx
+	enabled bool
+}
+
+func (t *commentingTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	tx, err := t.Tx.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &commentingTx{Tx: tx, enabled: t.enabled}, nil
+}
+
+func (t *commentingTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return t.Tx.Exec(ctx, annotate(ctx, t.enabled, sql), args...)
+}
+
+func (t *commentingTx) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return t.Tx.Query(ctx, annotate(ctx, t.enabled, sql), args...)
+}
+
+func (t *commentingTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return t.Tx.QueryRow(ctx, annotate(ctx, t.enabled, sql), args...)
+}
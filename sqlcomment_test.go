@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+func TestAnnotateOnlyWhenEnabled(t *testing.T) {
+	ctx := withQueryTags(context.Background(), queryTags{RequestId: "req-1", Route: "GET /account"})
+	const sql = "select 1"
+
+	if got := annotate(ctx, false, sql); got != sql {
+		t.Errorf("disabled: got %q, want the sql untouched", got)
+	}
+	want := "/* request_id='req-1',route='GET+%2Faccount' */ select 1"
+	if got := annotate(ctx, true, sql); got != want {
+		t.Errorf("enabled: got %q, want %q", got, want)
+	}
+	if got := annotate(context.Background(), true, sql); got != sql {
+		t.Errorf("no tags: got %q, want the sql untouched", got)
+	}
+}
+
+func TestSqlCommentCantBeClosed(t *testing.T) {
+	ctx := withQueryTags(context.Background(), queryTags{RequestId: "x' */ drop table account; /*"})
+	comment := sqlComment(ctx)
+	if strings.Count(comment, "*/") != 1 {
+		t.Errorf("request id escaped the comment: %q", comment)
+	}
+}
+
+// recordingTx remembers the sql it was last given
+type recordingTx struct {
+	pgx.Tx
+	sql string
+}
+
+func (t *recordingTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	t.sql = sql
+	return pgconn.CommandTag{}, nil
+}
+
+func TestCommentingTx(t *testing.T) {
+	ctx := withQueryTags(context.Background(), queryTags{RequestId: "req-1", Route: "r"})
+	for _, enabled := range []bool{false, true} {
+		inner := &recordingTx{}
+		tx := &commentingTx{Tx: inner, enabled: enabled}
+		tx.Exec(ctx, "update account set balance = 0")
+		if commented := strings.HasPrefix(inner.sql, "/* request_id='req-1'"); commented != enabled {
+			t.Errorf("enabled=%v: transaction ran %q", enabled, inner.sql)
+		}
+	}
+}
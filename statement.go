@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/go-pdf/fpdf"
+)
+
+// renderStatementPdf lays out the statement: who it's for, the period, the
+// opening and closing balance, and every ledger entry in between, on as many
+// letter sized pages as it takes.
+func renderStatementPdf(account *Account, statement *Statement) ([]byte, error) {
+	// the statement's To is exclusive, show the last day it covers
+	lastDay := statement.To.AddDate(0, 0, -1)
+
+	pdf := fpdf.New("P", "pt", "Letter", "")
+	pdf.SetMargins(54, 54, 54)
+	pdf.SetAutoPageBreak(true, 54)
+	pdf.SetTitle("Chorse account statement", true)
+	// the core fonts are cp1252, so names with accents need translating
+	tr := pdf.UnicodeTranslatorFromDescriptor("")
+	pdf.AddPage()
+
+	line := func(text string, size float64) {
+		pdf.SetFont("Helvetica", "", size)
+		pdf.CellFormat(0, size*1.4, tr(text), "", 1, "L", false, 0, "")
+	}
+	gap := func() { pdf.Ln(14) }
+
+	line("Chorse account statement", 18)
+	gap()
+	line(fmt.Sprintf("%s %s", account.FirstName, account.LastName), 12)
+	line(fmt.Sprintf("Account number %d", account.Number), 12)
+	line(fmt.Sprintf("Period %s to %s", statement.From.Format(time.DateOnly), lastDay.Format(time.DateOnly)), 12)
+	gap()
+	line(fmt.Sprintf("Opening balance: %s", formatMoney(statement.OpeningBalance, account.Currency)), 12)
+	gap()
+
+	if len(statement.Entries) == 0 {
+		line("No transactions in this period.", 10)
+	}
+	pdf.SetFont("Helvetica", "", 10)
+	for _, entry := range statement.Entries {
+		pdf.CellFormat(120, 14, entry.CreatedAt.UTC().Format("2006-01-02 15:04"), "", 0, "L", false, 0, "")
+		pdf.CellFormat(100, 14, entry.Kind, "", 0, "L", false, 0, "")
+		pdf.CellFormat(100, 14, tr(formatMoney(entry.Amount, account.Currency)), "", 1, "R", false, 0, "")
+	}
+
+	gap()
+	line(fmt.Sprintf("Closing balance: %s", formatMoney(statement.ClosingBalance, account.Currency)), 12)
+
+	var out bytes.Buffer
+	if err := pdf.Output(&out); err != nil {
+		return nil, err
+	}
+	return out.Bytes(), nil
+}
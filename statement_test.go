@@ -0,0 +1,43 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestStatementIsPdf(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	account, token := newTestAccount(t, s, "Zoë", "Ångström")
+	if _, err := s.store.Deposit(context.Background(), account.Id, 1250, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	today := time.Now().UTC().Format(time.DateOnly)
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/account/%d/statement?from=%s&to=%s", account.Id, today, today), nil)
+	rec := serve(s, req, token)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	if got := rec.Header().Get("Content-Type"); got != "application/pdf" {
+		t.Errorf("content type %q, want application/pdf", got)
+	}
+	body := rec.Body.Bytes()
+	if !bytes.HasPrefix(body, []byte("%PDF-")) || !bytes.Contains(body, []byte("%%EOF")) {
+		t.Fatalf("body isn't a whole pdf (%d bytes)", len(body))
+	}
+}
+
+func TestStatementOfSomeoneElsesAccount(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	_, token := newTestAccount(t, s, "Ada", "Lovelace")
+	rec := serve(s, httptest.NewRequest(http.MethodGet, "/account/999/statement", nil), token)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("status %d, want 403", rec.Code)
+	}
+}
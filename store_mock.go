@@ -0,0 +1,1090 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// MockStore is an in memory Storage for exercising handlers without a
+// database. It keeps to the contracts PostgresStore documents (nil for
+// missing rows, the same sentinel errors, ledger entries for every balance
+// change) but makes no attempt at its performance or isolation.
+//
+// Errors injects failures: a method whose name is a key returns that error
+// instead of doing anything, e.g. Errors["GetAccountById"] = io.ErrUnexpectedEOF.
+type MockStore struct {
+	Errors map[string]error
+
+	mu           sync.Mutex
+	nextId       int
+	accounts     map[int]*Account
+	alerted      map[int]bool
+	whitelists   map[int]*TransferWhitelist
+	ledger       []*LedgerEntry
+	archived     map[int]bool // ledger entry ids, still kept in ledger
+	transfers    []*TransferRecord
+	snapshots    []*BalanceSnapshot
+	discordUsers map[string]*DiscordUser
+}
+
+func NewMockStore() *MockStore {
+	return &MockStore{
+		Errors:       map[string]error{},
+		nextId:       1,
+		accounts:     map[int]*Account{},
+		alerted:      map[int]bool{},
+		whitelists:   map[int]*TransferWhitelist{},
+		archived:     map[int]bool{},
+		discordUsers: map[string]*DiscordUser{},
+	}
+}
+
+// fail is the injected error for method, if any. Callers hold mu.
+func (m *MockStore) fail(method string) error {
+	return m.Errors[method]
+}
+
+// WithTx runs fn against the mock itself. If fn fails, everything it
+// changed is put back like a rolled back transaction would, though unlike
+// one its changes are seen by other callers while it runs.
+func (m *MockStore) WithTx(ctx context.Context, fn func(tx Storage) error) error {
+	m.mu.Lock()
+	if err := m.fail("WithTx"); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	saved := m.cloneState()
+	m.mu.Unlock()
+
+	if err := fn(m); err != nil {
+		m.mu.Lock()
+		m.restoreState(saved)
+		m.mu.Unlock()
+		return err
+	}
+	return nil
+}
+
+// cloneState copies everything the store holds, for restoreState. Callers
+// hold mu.
+func (m *MockStore) cloneState() *MockStore {
+	saved := &MockStore{
+		nextId:       m.nextId,
+		accounts:     make(map[int]*Account, len(m.accounts)),
+		alerted:      maps.Clone(m.alerted),
+		whitelists:   make(map[int]*TransferWhitelist, len(m.whitelists)),
+		ledger:       slices.Clone(m.ledger),
+		archived:     maps.Clone(m.archived),
+		transfers:    slices.Clone(m.transfers),
+		snapshots:    slices.Clone(m.snapshots),
+		discordUsers: make(map[string]*DiscordUser, len(m.discordUsers)),
+	}
+	for id, account := range m.accounts {
+		saved.accounts[id] = copyAccount(account)
+	}
+	for id, whitelist := range m.whitelists {
+		saved.whitelists[id] = &TransferWhitelist{Enabled: whitelist.Enabled, Numbers: slices.Clone(whitelist.Numbers)}
+	}
+	for id, user := range m.discordUsers {
+		u := *user
+		saved.discordUsers[id] = &u
+	}
+	return saved
+}
+
+// restoreState puts back what cloneState copied. Callers hold mu.
+func (m *MockStore) restoreState(saved *MockStore) {
+	m.nextId = saved.nextId
+	m.accounts = saved.accounts
+	m.alerted = saved.alerted
+	m.whitelists = saved.whitelists
+	m.ledger = saved.ledger
+	m.archived = saved.archived
+	m.transfers = saved.transfers
+	m.snapshots = saved.snapshots
+	m.discordUsers = saved.discordUsers
+}
+
+// copyAccount keeps callers from changing stored accounts behind our back
+func copyAccount(account *Account) *Account {
+	c := *account
+	return &c
+}
+
+// equalPtr says whether a and b are both nil or point at equal values
+func equalPtr[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// sortedAccounts is every account in id order. Callers hold mu.
+func (m *MockStore) sortedAccounts() []*Account {
+	accounts := make([]*Account, 0, len(m.accounts))
+	for _, account := range m.accounts {
+		accounts = append(accounts, account)
+	}
+	sort.Slice(accounts, func(i, j int) bool { return accounts[i].Id < accounts[j].Id })
+	return accounts
+}
+
+// liveAccounts is sortedAccounts without the soft deleted ones. Callers
+// hold mu.
+func (m *MockStore) liveAccounts() []*Account {
+	live := []*Account{}
+	for _, account := range m.sortedAccounts() {
+		if account.DeletedAt == nil {
+			live = append(live, account)
+		}
+	}
+	return live
+}
+
+// liveAccount is the account with id, unless it's missing or soft deleted.
+// Callers hold mu.
+func (m *MockStore) liveAccount(id int) (*Account, bool) {
+	account, ok := m.accounts[id]
+	if !ok || account.DeletedAt != nil {
+		return nil, false
+	}
+	return account, true
+}
+
+// numberTaken mirrors the account_number_key unique index. Callers hold mu.
+func (m *MockStore) numberTaken(number int64, exceptId int) bool {
+	for _, account := range m.accounts {
+		if account.Number == number && account.Id != exceptId {
+			return true
+		}
+	}
+	return false
+}
+
+// record adds a ledger entry and moves the balance with it. Callers hold mu.
+func (m *MockStore) record(account *Account, delta int64, kind string) {
+	if delta == 0 {
+		return
+	}
+	now := time.Now().UTC()
+	account.Balance += Amount(delta)
+	account.UpdatedAt = now
+	account.Version++
+	m.ledger = append(m.ledger, &LedgerEntry{
+		Id:        len(m.ledger) + 1,
+		AccountId: account.Id,
+		Amount:    Amount(delta),
+		Kind:      kind,
+		CreatedAt: now,
+	})
+}
+
+func (m *MockStore) CreateAccount(ctx context.Context, account *Account) (*Account, error) {
+	return m.createAccount("CreateAccount", account, 0)
+}
+
+func (m *MockStore) CreateAccountWithDeposit(ctx context.Context, account *Account, deposit int64) (*Account, error) {
+	return m.createAccount("CreateAccountWithDeposit", account, deposit)
+}
+
+func (m *MockStore) createAccount(method string, account *Account, deposit int64) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail(method); err != nil {
+		return nil, err
+	}
+	if m.numberTaken(account.Number, 0) {
+		return nil, &DuplicateError{Field: "number"}
+	}
+	if account.ExternalId != nil {
+		for _, existing := range m.accounts {
+			if existing.ExternalId != nil && *existing.ExternalId == *account.ExternalId {
+				return nil, &DuplicateError{Field: "externalId"}
+			}
+		}
+	}
+
+	stored := copyAccount(account)
+	stored.Id = m.nextId
+	m.nextId++
+	stored.Balance = 0
+	stored.UpdatedAt = time.Now().UTC()
+	m.accounts[stored.Id] = stored
+	m.record(stored, deposit, LedgerDeposit)
+	// the deposit goes in with the insert, so it isn't a write of its own
+	stored.Version = 1
+	return copyAccount(stored), nil
+}
+
+func (m *MockStore) DeleteAccount(ctx context.Context, id int, hard bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("DeleteAccount"); err != nil {
+		return err
+	}
+	if !hard {
+		account, ok := m.liveAccount(id)
+		if !ok {
+			return ErrAccountNotFound
+		}
+		now := time.Now().UTC()
+		account.DeletedAt = &now
+		account.UpdatedAt = now
+		return nil
+	}
+	if _, ok := m.accounts[id]; !ok {
+		return ErrAccountNotFound
+	}
+	delete(m.accounts, id)
+	delete(m.whitelists, id)
+	snapshots := m.snapshots[:0]
+	for _, snapshot := range m.snapshots {
+		if snapshot.AccountId != id {
+			snapshots = append(snapshots, snapshot)
+		}
+	}
+	m.snapshots = snapshots
+
+	// the ledger cascades, transfers keep their row but lose the account
+	ledger := m.ledger[:0]
+	for _, entry := range m.ledger {
+		if entry.AccountId != id {
+			ledger = append(ledger, entry)
+		}
+	}
+	m.ledger = ledger
+	for _, transfer := range m.transfers {
+		if transfer.FromAccount != nil && *transfer.FromAccount == id {
+			transfer.FromAccount, transfer.FromNumber = nil, nil
+		}
+		if transfer.ToAccount != nil && *transfer.ToAccount == id {
+			transfer.ToAccount, transfer.ToNumber = nil, nil
+		}
+	}
+	return nil
+}
+
+func (m *MockStore) UpdateAccount(ctx context.Context, account *Account) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("UpdateAccount"); err != nil {
+		return nil, err
+	}
+	stored, ok := m.liveAccount(account.Id)
+	if !ok {
+		return nil, nil
+	}
+	if stored.Version != account.Version {
+		return nil, ErrVersionConflict
+	}
+	stored.FirstName = account.FirstName
+	stored.LastName = account.LastName
+	if !equalPtr(stored.Email, account.Email) {
+		stored.EmailVerified = false
+	}
+	stored.Email = account.Email
+	stored.UpdatedAt = time.Now().UTC()
+	stored.Version++
+	return copyAccount(stored), nil
+}
+
+func (m *MockStore) GetAccounts(ctx context.Context, limit, offset int) ([]*Account, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccounts"); err != nil {
+		return nil, 0, err
+	}
+	all := m.liveAccounts()
+	page := []*Account{}
+	for i := offset; i < len(all) && i < offset+limit; i++ {
+		page = append(page, copyAccount(all[i]))
+	}
+	return page, int64(len(all)), nil
+}
+
+func (m *MockStore) SearchAccounts(ctx context.Context, query string, limit, offset int) ([]*Account, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("SearchAccounts"); err != nil {
+		return nil, 0, err
+	}
+	query = strings.ToLower(query)
+	matches := []*Account{}
+	for _, account := range m.liveAccounts() {
+		if strings.Contains(strings.ToLower(account.FirstName), query) || strings.Contains(strings.ToLower(account.LastName), query) {
+			matches = append(matches, account)
+		}
+	}
+	page := []*Account{}
+	for i := offset; i < len(matches) && i < offset+limit; i++ {
+		page = append(page, copyAccount(matches[i]))
+	}
+	return page, int64(len(matches)), nil
+}
+
+func (m *MockStore) GetAccountById(ctx context.Context, id int) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccountById"); err != nil {
+		return nil, err
+	}
+	if account, ok := m.liveAccount(id); ok {
+		return copyAccount(account), nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) GetAccountByNumber(ctx context.Context, number int64) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccountByNumber"); err != nil {
+		return nil, err
+	}
+	for _, account := range m.liveAccounts() {
+		if account.Number == number {
+			return copyAccount(account), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockStore) GetAccountsByNumbers(ctx context.Context, numbers []int64) (map[int64]*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccountsByNumbers"); err != nil {
+		return nil, err
+	}
+	byNumber := map[int64]*Account{}
+	for _, account := range m.liveAccounts() {
+		if slices.Contains(numbers, account.Number) {
+			byNumber[account.Number] = copyAccount(account)
+		}
+	}
+	return byNumber, nil
+}
+
+func (m *MockStore) GetAccountByExternalId(ctx context.Context, externalId string) (*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccountByExternalId"); err != nil {
+		return nil, err
+	}
+	for _, account := range m.liveAccounts() {
+		if account.ExternalId != nil && *account.ExternalId == externalId {
+			return copyAccount(account), nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *MockStore) RevokeTokens(ctx context.Context, id int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("RevokeTokens"); err != nil {
+		return 0, err
+	}
+	account, ok := m.liveAccount(id)
+	if !ok {
+		return 0, ErrAccountNotFound
+	}
+	account.TokenEpoch++
+	return account.TokenEpoch, nil
+}
+
+func (m *MockStore) GetAccountsModifiedSince(ctx context.Context, since time.Time, limit int) ([]*Account, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccountsModifiedSince"); err != nil {
+		return nil, err
+	}
+	modified := []*Account{}
+	for _, account := range m.sortedAccounts() {
+		if account.UpdatedAt.After(since) {
+			modified = append(modified, copyAccount(account))
+		}
+	}
+	sort.SliceStable(modified, func(i, j int) bool { return modified[i].UpdatedAt.Before(modified[j].UpdatedAt) })
+	if len(modified) > limit {
+		modified = modified[:limit]
+	}
+	return modified, nil
+}
+
+func (m *MockStore) AccountExists(ctx context.Context, id int) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("AccountExists"); err != nil {
+		return false, err
+	}
+	_, ok := m.liveAccount(id)
+	return ok, nil
+}
+
+func (m *MockStore) StreamAccounts(ctx context.Context, fn func(*Account) error) error {
+	m.mu.Lock()
+	if err := m.fail("StreamAccounts"); err != nil {
+		m.mu.Unlock()
+		return err
+	}
+	accounts := m.liveAccounts()
+	for i := range accounts {
+		accounts[i] = copyAccount(accounts[i])
+	}
+	m.mu.Unlock()
+
+	for _, account := range accounts {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if err := fn(account); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *MockStore) Deposit(ctx context.Context, id int, amount int64, expectedVersion *int64) (int64, error) {
+	return m.adjustBalance("Deposit", id, amount, LedgerDeposit, expectedVersion)
+}
+
+func (m *MockStore) Withdraw(ctx context.Context, id int, amount int64, expectedVersion *int64) (int64, error) {
+	return m.adjustBalance("Withdraw", id, -amount, LedgerWithdrawal, expectedVersion)
+}
+
+func (m *MockStore) adjustBalance(method string, id int, delta int64, kind string, expectedVersion *int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail(method); err != nil {
+		return 0, err
+	}
+	account, ok := m.liveAccount(id)
+	if !ok {
+		return 0, fmt.Errorf("%w: %d", ErrAccountNotFound, id)
+	}
+	if expectedVersion != nil && account.Version != *expectedVersion {
+		return 0, ErrVersionConflict
+	}
+	if int64(account.Balance)+delta < 0 {
+		return 0, ErrInsufficientFunds
+	}
+	m.record(account, delta, kind)
+	return int64(account.Balance), nil
+}
+
+func (m *MockStore) Transfer(ctx context.Context, fromID, toID int, amount int64, fee FeeCharge, expectedVersion *int64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("Transfer"); err != nil {
+		return 0, err
+	}
+	if fromID == toID {
+		return 0, ErrSameAccount
+	}
+	debit := amount + fee.Amount
+	if debit < amount {
+		return 0, ErrBalanceOutOfRange
+	}
+
+	from, ok := m.liveAccount(fromID)
+	if !ok {
+		return 0, fmt.Errorf("%w: %d", ErrAccountNotFound, fromID)
+	}
+	to, ok := m.liveAccount(toID)
+	if !ok {
+		return 0, fmt.Errorf("%w: %d", ErrAccountNotFound, toID)
+	}
+	if expectedVersion != nil && from.Version != *expectedVersion {
+		return 0, ErrVersionConflict
+	}
+	feeAccount, ok := m.liveAccount(fee.Account)
+	if fee.Amount > 0 && fee.Account != 0 && !ok {
+		return 0, fmt.Errorf("fee account %d does not exist", fee.Account)
+	}
+	if to.Currency != from.Currency {
+		return 0, ErrCurrencyMismatch
+	}
+	if fee.Amount > 0 && fee.Account != 0 && feeAccount.Currency != from.Currency {
+		return 0, fmt.Errorf("fee account %d is in %s, not %s", fee.Account, feeAccount.Currency, from.Currency)
+	}
+	if whitelist, ok := m.whitelists[fromID]; ok && whitelist.Enabled && !slices.Contains(whitelist.Numbers, to.Number) {
+		return 0, ErrNotWhitelisted
+	}
+	if int64(from.Balance) < debit {
+		return 0, ErrInsufficientFunds
+	}
+
+	m.transfers = append(m.transfers, &TransferRecord{
+		Id:          len(m.transfers) + 1,
+		FromAccount: &from.Id,
+		FromNumber:  &from.Number,
+		ToAccount:   &to.Id,
+		ToNumber:    &to.Number,
+		Amount:      Amount(amount),
+		CreatedAt:   time.Now().UTC(),
+	})
+	m.record(from, -amount, LedgerTransfer)
+	m.record(to, amount, LedgerTransfer)
+	m.record(from, -fee.Amount, LedgerFee)
+	if fee.Account != 0 {
+		m.record(feeAccount, fee.Amount, LedgerFee)
+	}
+	return int64(from.Balance), nil
+}
+
+func (m *MockStore) GetTotalBalance(ctx context.Context, includeSandbox bool) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetTotalBalance"); err != nil {
+		return 0, err
+	}
+	return m.totalBalance(includeSandbox), nil
+}
+
+func (m *MockStore) totalBalance(includeSandbox bool) int64 {
+	var total int64
+	for _, account := range m.accounts {
+		if account.Sandbox && !includeSandbox {
+			continue
+		}
+		total += int64(account.Balance)
+	}
+	return total
+}
+
+func (m *MockStore) Reconcile(ctx context.Context, includeSandbox bool) (*Reconciliation, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("Reconcile"); err != nil {
+		return nil, err
+	}
+	rec := &Reconciliation{TotalBalance: Amount(m.totalBalance(includeSandbox)), MismatchedAccounts: []int{}}
+	perAccount := map[int]Amount{}
+	for _, entry := range m.ledger {
+		if account, ok := m.accounts[entry.AccountId]; ok && account.Sandbox && !includeSandbox {
+			continue
+		}
+		rec.LedgerTotal += entry.Amount
+		perAccount[entry.AccountId] += entry.Amount
+	}
+	for _, account := range m.sortedAccounts() {
+		if account.Sandbox && !includeSandbox {
+			continue
+		}
+		if account.Balance != perAccount[account.Id] && len(rec.MismatchedAccounts) < maxReconcileMismatches {
+			rec.MismatchedAccounts = append(rec.MismatchedAccounts, account.Id)
+		}
+	}
+	rec.Discrepancy = rec.TotalBalance - rec.LedgerTotal
+	rec.Balanced = rec.Discrepancy == 0 && len(rec.MismatchedAccounts) == 0
+	return rec, nil
+}
+
+func (m *MockStore) ApplyInterest(ctx context.Context, rate float64) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("ApplyInterest"); err != nil {
+		return 0, err
+	}
+	if rate <= -1 {
+		return 0, ErrInvalidRate
+	}
+	kind := LedgerInterest
+	if rate < 0 {
+		kind = LedgerFee
+	}
+	var changed int64
+	for _, account := range m.liveAccounts() {
+		if account.Balance <= 0 {
+			continue
+		}
+		if delta := int64(math.Round(float64(account.Balance) * rate)); delta != 0 {
+			m.record(account, delta, kind)
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+func (m *MockStore) FindDuplicateAccounts(ctx context.Context, limit, offset int) ([]*DuplicateAccountGroup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("FindDuplicateAccounts"); err != nil {
+		return nil, err
+	}
+	byKey := map[string][]*Account{}
+	for _, account := range m.liveAccounts() {
+		key := nameKey(account.FirstName, account.LastName)
+		byKey[key] = append(byKey[key], copyAccount(account))
+	}
+	keys := []string{}
+	for key, accounts := range byKey {
+		if len(accounts) > 1 {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	groups := []*DuplicateAccountGroup{}
+	for i := offset; i < len(keys) && i < offset+limit; i++ {
+		groups = append(groups, &DuplicateAccountGroup{Key: keys[i], Accounts: byKey[keys[i]]})
+	}
+	return groups, nil
+}
+
+func (m *MockStore) GetAccountTransactions(ctx context.Context, id, limit, offset int, includeArchived bool) ([]*LedgerEntry, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetAccountTransactions"); err != nil {
+		return nil, err
+	}
+	// the ledger is in insertion order, so newest first is back to front
+	entries := []*LedgerEntry{}
+	skipped := 0
+	for i := len(m.ledger) - 1; i >= 0 && len(entries) < limit; i-- {
+		if m.ledger[i].AccountId != id || (m.archived[m.ledger[i].Id] && !includeArchived) {
+			continue
+		}
+		if skipped < offset {
+			skipped++
+			continue
+		}
+		entry := *m.ledger[i]
+		entries = append(entries, &entry)
+	}
+	return entries, nil
+}
+
+func (m *MockStore) ArchiveTransactionsBefore(ctx context.Context, cutoff time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("ArchiveTransactionsBefore"); err != nil {
+		return 0, err
+	}
+	var moved int64
+	for _, entry := range m.ledger {
+		if entry.CreatedAt.Before(cutoff) && !m.archived[entry.Id] {
+			m.archived[entry.Id] = true
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+func (m *MockStore) TakeBalanceSnapshot(ctx context.Context) (*SnapshotRun, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("TakeBalanceSnapshot"); err != nil {
+		return nil, err
+	}
+	run := &SnapshotRun{TakenAt: time.Now().UTC()}
+	for _, account := range m.liveAccounts() {
+		m.snapshots = append(m.snapshots, &BalanceSnapshot{
+			AccountId: account.Id,
+			TakenAt:   run.TakenAt,
+			Balance:   account.Balance,
+			Currency:  account.Currency,
+		})
+		run.Accounts++
+	}
+	return run, nil
+}
+
+func (m *MockStore) GetSnapshot(ctx context.Context, id int, at time.Time) (*BalanceSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetSnapshot"); err != nil {
+		return nil, err
+	}
+	var latest *BalanceSnapshot
+	for _, snapshot := range m.snapshots {
+		if snapshot.AccountId == id && !snapshot.TakenAt.After(at) && (latest == nil || snapshot.TakenAt.After(latest.TakenAt)) {
+			latest = snapshot
+		}
+	}
+	if latest == nil {
+		return nil, nil
+	}
+	found := *latest
+	return &found, nil
+}
+
+func (m *MockStore) GetStatement(ctx context.Context, id int, from, to time.Time) (*Statement, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetStatement"); err != nil {
+		return nil, err
+	}
+	account, ok := m.liveAccount(id)
+	if !ok {
+		return nil, ErrAccountNotFound
+	}
+
+	statement := &Statement{AccountId: id, From: from, To: to, ClosingBalance: account.Balance}
+	for _, entry := range m.ledger {
+		if entry.AccountId != id {
+			continue
+		}
+		if !entry.CreatedAt.Before(to) {
+			statement.ClosingBalance -= entry.Amount
+		} else if !entry.CreatedAt.Before(from) {
+			e := *entry
+			statement.Entries = append(statement.Entries, &e)
+		}
+	}
+	statement.OpeningBalance = statement.ClosingBalance
+	for _, entry := range statement.Entries {
+		statement.OpeningBalance -= entry.Amount
+	}
+	return statement, nil
+}
+
+func (m *MockStore) SetLowBalanceThreshold(ctx context.Context, id int, threshold *int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("SetLowBalanceThreshold"); err != nil {
+		return err
+	}
+	account, ok := m.liveAccount(id)
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.LowBalanceThreshold = threshold
+	account.UpdatedAt = time.Now().UTC()
+	account.Version++
+	m.alerted[id] = false
+	return nil
+}
+
+func (m *MockStore) CheckLowBalances(ctx context.Context, ids ...int) ([]*LowBalanceAlert, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("CheckLowBalances"); err != nil {
+		return nil, err
+	}
+	wanted := map[int]bool{}
+	for _, id := range ids {
+		wanted[id] = true
+	}
+
+	alerts := []*LowBalanceAlert{}
+	for _, account := range m.sortedAccounts() {
+		if account.LowBalanceThreshold == nil || (len(ids) > 0 && !wanted[account.Id]) {
+			continue
+		}
+		low := int64(account.Balance) < *account.LowBalanceThreshold
+		if low == m.alerted[account.Id] {
+			continue
+		}
+		m.alerted[account.Id] = low
+		if low {
+			alerts = append(alerts, &LowBalanceAlert{
+				AccountId: account.Id,
+				Number:    account.Number,
+				Balance:   int64(account.Balance),
+				Threshold: *account.LowBalanceThreshold,
+				Email:     account.Email,
+			})
+		}
+	}
+	return alerts, nil
+}
+
+func (m *MockStore) GetTransferWhitelist(ctx context.Context, id int) (*TransferWhitelist, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetTransferWhitelist"); err != nil {
+		return nil, err
+	}
+	if _, ok := m.accounts[id]; !ok {
+		return nil, nil
+	}
+	whitelist := &TransferWhitelist{Numbers: []int64{}}
+	if stored, ok := m.whitelists[id]; ok {
+		whitelist.Enabled = stored.Enabled
+		whitelist.Numbers = slices.Clone(stored.Numbers)
+	}
+	return whitelist, nil
+}
+
+// whitelist is the account's stored whitelist, made on first use. Callers
+// hold mu and have checked the account exists.
+func (m *MockStore) whitelist(id int) *TransferWhitelist {
+	whitelist, ok := m.whitelists[id]
+	if !ok {
+		whitelist = &TransferWhitelist{Numbers: []int64{}}
+		m.whitelists[id] = whitelist
+	}
+	return whitelist
+}
+
+func (m *MockStore) SetTransferWhitelistEnabled(ctx context.Context, id int, enabled bool) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("SetTransferWhitelistEnabled"); err != nil {
+		return err
+	}
+	if _, ok := m.accounts[id]; !ok {
+		return ErrAccountNotFound
+	}
+	m.whitelist(id).Enabled = enabled
+	return nil
+}
+
+func (m *MockStore) MarkEmailVerified(ctx context.Context, id int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("MarkEmailVerified"); err != nil {
+		return err
+	}
+	account, ok := m.liveAccount(id)
+	if !ok {
+		return ErrAccountNotFound
+	}
+	account.EmailVerified = true
+	return nil
+}
+
+func (m *MockStore) AddToTransferWhitelist(ctx context.Context, id int, number int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("AddToTransferWhitelist"); err != nil {
+		return err
+	}
+	if _, ok := m.accounts[id]; !ok {
+		return ErrAccountNotFound
+	}
+	whitelist := m.whitelist(id)
+	if !slices.Contains(whitelist.Numbers, number) {
+		whitelist.Numbers = append(whitelist.Numbers, number)
+		slices.Sort(whitelist.Numbers)
+	}
+	return nil
+}
+
+func (m *MockStore) RemoveFromTransferWhitelist(ctx context.Context, id int, number int64) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("RemoveFromTransferWhitelist"); err != nil {
+		return err
+	}
+	if whitelist, ok := m.whitelists[id]; ok {
+		whitelist.Numbers = slices.DeleteFunc(whitelist.Numbers, func(n int64) bool { return n == number })
+	}
+	return nil
+}
+
+func (m *MockStore) GetDailyTransferCounts(ctx context.Context, from, to time.Time, includeSandbox bool) ([]*DailyTransferCount, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetDailyTransferCounts"); err != nil {
+		return nil, err
+	}
+	day := func(t time.Time) time.Time {
+		return t.UTC().Truncate(24 * time.Hour)
+	}
+	counts := []*DailyTransferCount{}
+	for d := day(from); !d.After(day(to)); d = d.AddDate(0, 0, 1) {
+		count := &DailyTransferCount{Day: d}
+		for _, transfer := range m.transfers {
+			if day(transfer.CreatedAt).Equal(d) && (includeSandbox || !m.sandboxTransfer(transfer)) {
+				count.Count++
+				count.Amount += transfer.Amount
+			}
+		}
+		counts = append(counts, count)
+	}
+	return counts, nil
+}
+
+// sandboxTransfer is whether either side of the transfer is a sandbox account
+func (m *MockStore) sandboxTransfer(transfer *TransferRecord) bool {
+	for _, id := range []*int{transfer.FromAccount, transfer.ToAccount} {
+		if id == nil {
+			continue
+		}
+		if account, ok := m.accounts[*id]; ok && account.Sandbox {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *MockStore) GetRecentTransactions(ctx context.Context, limit int) ([]*TransferRecord, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetRecentTransactions"); err != nil {
+		return nil, err
+	}
+	recent := []*TransferRecord{}
+	for i := len(m.transfers) - 1; i >= 0 && len(recent) < limit; i-- {
+		transfer := *m.transfers[i]
+		recent = append(recent, &transfer)
+	}
+	return recent, nil
+}
+
+func (m *MockStore) DiscordUserExists(ctx context.Context, id string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("DiscordUserExists"); err != nil {
+		return false, err
+	}
+	_, ok := m.discordUsers[id]
+	return ok, nil
+}
+
+func (m *MockStore) GetDiscordUser(ctx context.Context, id string) (*DiscordUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("GetDiscordUser"); err != nil {
+		return nil, err
+	}
+	if user, ok := m.discordUsers[id]; ok {
+		u := *user
+		return &u, nil
+	}
+	return nil, nil
+}
+
+func (m *MockStore) UpsertDiscordUser(ctx context.Context, user *DiscordUser) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("UpsertDiscordUser"); err != nil {
+		return false, err
+	}
+	previous, seen := m.discordUsers[user.Id]
+	stored := *user
+	stored.LastSignIn = time.Now().UTC()
+	if seen {
+		stored.SignedOutAt = previous.SignedOutAt
+	}
+	stored.DeactivatedAt = nil
+	m.discordUsers[user.Id] = &stored
+	return !seen, nil
+}
+
+func (m *MockStore) SignOutDiscordUser(ctx context.Context, id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("SignOutDiscordUser"); err != nil {
+		return err
+	}
+	if user, ok := m.discordUsers[id]; ok {
+		now := time.Now().UTC()
+		user.SignedOutAt = &now
+	}
+	return nil
+}
+
+func (m *MockStore) ClearExpiredSignOuts(ctx context.Context, before time.Time, limit int) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("ClearExpiredSignOuts"); err != nil {
+		return 0, err
+	}
+	var cleared int64
+	for _, user := range m.discordUsers {
+		if cleared >= int64(limit) {
+			break
+		}
+		if user.SignedOutAt != nil && user.SignedOutAt.Before(before) {
+			user.SignedOutAt = nil
+			cleared++
+		}
+	}
+	return cleared, nil
+}
+
+func (m *MockStore) ListDiscordUsers(ctx context.Context, q string, limit, offset int) ([]*DiscordUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("ListDiscordUsers"); err != nil {
+		return nil, err
+	}
+	matches := []*DiscordUser{}
+	for _, user := range m.discordUsers {
+		if q == "" || strings.Contains(strings.ToLower(user.GlobalName), strings.ToLower(q)) {
+			u := *user
+			matches = append(matches, &u)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].LastSignIn.Equal(matches[j].LastSignIn) {
+			return matches[i].LastSignIn.After(matches[j].LastSignIn)
+		}
+		return matches[i].Id < matches[j].Id
+	})
+	if offset >= len(matches) {
+		return []*DiscordUser{}, nil
+	}
+	return matches[offset:min(offset+limit, len(matches))], nil
+}
+
+func (m *MockStore) ListInactiveDiscordUsers(ctx context.Context, before time.Time, limit, offset int) ([]*DiscordUser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("ListInactiveDiscordUsers"); err != nil {
+		return nil, err
+	}
+	matches := []*DiscordUser{}
+	for _, user := range m.discordUsers {
+		if user.LastSignIn.Before(before) && user.DeactivatedAt == nil {
+			u := *user
+			matches = append(matches, &u)
+		}
+	}
+	sort.Slice(matches, func(i, j int) bool {
+		if !matches[i].LastSignIn.Equal(matches[j].LastSignIn) {
+			return matches[i].LastSignIn.Before(matches[j].LastSignIn)
+		}
+		return matches[i].Id < matches[j].Id
+	})
+	if offset >= len(matches) {
+		return []*DiscordUser{}, nil
+	}
+	return matches[offset:min(offset+limit, len(matches))], nil
+}
+
+func (m *MockStore) DeactivateInactiveDiscordUsers(ctx context.Context, before time.Time) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("DeactivateInactiveDiscordUsers"); err != nil {
+		return 0, err
+	}
+	now := time.Now().UTC()
+	var deactivated int64
+	for _, user := range m.discordUsers {
+		if user.LastSignIn.Before(before) && user.DeactivatedAt == nil {
+			user.DeactivatedAt = &now
+			user.SignedOutAt = &now
+			deactivated++
+		}
+	}
+	return deactivated, nil
+}
+
+func (m *MockStore) Ping(ctx context.Context) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fail("Ping")
+}
+
+func (m *MockStore) MissingTables(ctx context.Context) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if err := m.fail("MissingTables"); err != nil {
+		return nil, err
+	}
+	return []string{}, nil
+}
+
+func (m *MockStore) Close() {}
+
+var _ Storage = (*MockStore)(nil)
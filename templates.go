@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"html/template"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// templDir holds the layout and error pages
+const templDir = "./templ"
+
+// viewDir holds the views, the pages' main content
+const viewDir = "./view"
+
+// layoutTemplate wraps every full page
+const layoutTemplate = "index.gohtml"
+
+// parseTemplates parses every .gohtml file in dirs into one set, each
+// template named after its file, so a broken one shows up at startup rather
+// than as a 500 on some user's first page load. Every template gets funcs.
+func parseTemplates(funcs template.FuncMap, dirs ...string) (*template.Template, error) {
+	t := template.New("").Funcs(funcs)
+	for _, dir := range dirs {
+		var err error
+		if t, err = t.ParseGlob(filepath.Join(dir, "*.gohtml")); err != nil {
+			return nil, fmt.Errorf("loading templates: %w", err)
+		}
+	}
+	return t, nil
+}
+
+// errorTemplate is the error page for the environment
+func (s *ApiServer) errorTemplate() string {
+	return fmt.Sprintf("error.%s.gohtml", s.config.Environment)
+}
+
+// checkTemplates makes sure the templates every page render needs, the
+// layout, the error page for the environment and the not found view, were
+// parsed
+func (s *ApiServer) checkTemplates() error {
+	for _, name := range []string{layoutTemplate, s.errorTemplate()} {
+		if s.templates.Lookup(name) == nil {
+			return fmt.Errorf("loading templates: %s/%s is missing", templDir, name)
+		}
+	}
+	if s.views.Lookup(notFoundView+".gohtml") == nil {
+		return fmt.Errorf("loading templates: %s/%s.gohtml is missing", viewDir, notFoundView)
+	}
+	return nil
+}
+
+// templateFuncs are the helpers views can call
+func (s *ApiServer) templateFuncs() template.FuncMap {
+	return template.FuncMap{
+		"accountNumber": func(number int64) string {
+			return formatAccountNumber(number, s.config.AccountNumberGroupSize, false)
+		},
+		"maskedAccountNumber": func(number int64) string {
+			return formatAccountNumber(number, s.config.AccountNumberGroupSize, true)
+		},
+		"money": formatMoney,
+	}
+}
+
+// formatAccountNumber splits the digits into groups of size, from the left,
+// so 1234567890 is "1234 5678 90". Masking replaces the digits of every group
+// but the last: "•••• •••• 90". A sign stays in front of the first group.
+func formatAccountNumber(number int64, size int, mask bool) string {
+	digits := strconv.FormatInt(number, 10)
+	sign := ""
+	if number < 0 {
+		sign, digits = "-", digits[1:]
+	}
+	groups := []string{}
+	for start := 0; start < len(digits); start += size {
+		end := min(start+size, len(digits))
+		groups = append(groups, digits[start:end])
+	}
+	if mask {
+		for i := range groups[:len(groups)-1] {
+			groups[i] = strings.Repeat("•", len(groups[i]))
+		}
+	}
+	return sign + strings.Join(groups, " ")
+}
+
+// errorPage is what the error templates get to work with. Detail is only
+// filled in outside of prod, since error text can leak internals.
+type errorPage struct {
+	Status     int
+	StatusText string
+	Detail     string
+	RequestId  string
+}
+
+// writeErrorPage renders templ/error.<env>.gohtml for err: just the fragment
+// for htmx requests, wrapped in the full layout for everything else.
+func (s *ApiServer) writeErrorPage(w http.ResponseWriter, r *http.Request, status int, err error) {
+	tags, _ := r.Context().Value(queryTagsKey{}).(queryTags)
+	if status >= 500 {
+		s.logger.ErrorContext(r.Context(), "request failed", "err", err)
+	}
+
+	page := errorPage{
+		Status:     status,
+		StatusText: http.StatusText(status),
+		RequestId:  tags.RequestId,
+	}
+	if s.config.Environment != EnvProd {
+		page.Detail = err.Error()
+	}
+
+	var fragment bytes.Buffer
+	if tErr := s.templates.ExecuteTemplate(&fragment, s.errorTemplate(), page); tErr != nil {
+		s.logger.ErrorContext(r.Context(), "rendering error page", "err", tErr)
+		http.Error(w, page.StatusText, status)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if r.Header.Get("Hx-Request") != "" {
+		WriteHtml(w, status, fragment.String())
+		return
+	}
+
+	w.WriteHeader(status)
+	s.templates.ExecuteTemplate(w, layoutTemplate, template.HTML(fragment.String()))
+}
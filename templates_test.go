@@ -0,0 +1,200 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestParseTemplatesFailsOnMalformedTemplate(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "index.gohtml"), []byte("<main>{{if .}}</main>"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := parseTemplates(nil, dir); err == nil {
+		t.Fatal("malformed template parsed")
+	}
+}
+
+func TestCheckTemplatesWantsLayoutAndErrorPage(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, layoutTemplate), []byte("{{.}}"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	templates, err := parseTemplates(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.templates = templates
+	if err := s.checkTemplates(); err == nil {
+		t.Fatal("missing error page went unnoticed")
+	}
+}
+
+func TestMissingTemplatesAreReported(t *testing.T) {
+	for name, dir := range map[string]string{
+		"missing dir": filepath.Join(t.TempDir(), "templ"),
+		"empty dir":   t.TempDir(),
+	} {
+		if _, err := parseTemplates(nil, dir); err == nil || !strings.Contains(err.Error(), "loading templates") {
+			t.Errorf("%s: err = %v", name, err)
+		}
+	}
+
+	s := newTestServer(t, NewMockStore())
+	dir := t.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, "home.gohtml"), []byte("home"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	views, err := parseTemplates(nil, dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.views = views
+	if err := s.checkTemplates(); err == nil || !strings.Contains(err.Error(), notFoundView+".gohtml") {
+		t.Errorf("missing not found view: err = %v", err)
+	}
+}
+
+func TestLayoutRendersPage(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	rec := httptest.NewRecorder()
+	if err := s.handleWholeView(rec, []byte("<p>hello</p>")); err != nil {
+		t.Fatal(err)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "<title>Chorse</title>") || !strings.Contains(body, "<p>hello</p>") {
+		t.Fatalf("page is missing the layout or content:\n%s", body)
+	}
+}
+
+func TestFormatAccountNumber(t *testing.T) {
+	tests := []struct {
+		number int64
+		size   int
+		mask   bool
+		want   string
+	}{
+		{1234567890, 4, false, "1234 5678 90"},
+		{1234567890, 4, true, "•••• •••• 90"},
+		{1234567890, 3, false, "123 456 789 0"},
+		{42, 4, false, "42"},
+		{-1234567, 4, false, "-1234 567"},
+		{-1234567, 4, true, "-•••• 567"},
+	}
+	for _, test := range tests {
+		if got := formatAccountNumber(test.number, test.size, test.mask); got != test.want {
+			t.Errorf("formatAccountNumber(%d, %d, %v) = %q, want %q", test.number, test.size, test.mask, got, test.want)
+		}
+	}
+}
+
+func TestAccountViewShowsGroupedNumber(t *testing.T) {
+	store := NewMockStore()
+	s := newTestServer(t, store)
+	account, err := store.CreateAccount(context.Background(), &Account{FirstName: "Ada", LastName: "Lovelace", Number: 1234567890, Currency: "USD"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.createJwt(account)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/view/account/%d", account.Id), nil)
+	req.Header.Set("x-jwt-token", token)
+	req.Header.Set("Hx-Request", "true")
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, req)
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200: %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "<dd>1234 5678 90</dd>") {
+		t.Errorf("account number isn't grouped:\n%s", body)
+	}
+	if strings.Contains(body, "<html") {
+		t.Error("htmx request got the whole layout")
+	}
+}
+
+func TestUnknownViewRendersNotFound(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	rec := httptest.NewRecorder()
+	s.routes().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/view/nope", nil))
+
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d, want 200", rec.Code)
+	}
+	body := rec.Body.String()
+	if !strings.Contains(body, "cannot be found") || !strings.Contains(body, "<title>Chorse</title>") {
+		t.Errorf("want the not found view in the layout, got:\n%s", body)
+	}
+}
+
+func TestErrorPageDetailByEnvironment(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	err := errors.New("pq: relation \"account\" does not exist")
+	for env, showsDetail := range map[string]bool{EnvProd: false, EnvDev: true} {
+		s.config.Environment = env
+		for _, htmx := range []bool{false, true} {
+			req := httptest.NewRequest(http.MethodGet, "/view/home", nil)
+			if htmx {
+				req.Header.Set("Hx-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			s.writeErrorPage(rec, req, http.StatusInternalServerError, err)
+
+			body := rec.Body.String()
+			if rec.Code != http.StatusInternalServerError {
+				t.Errorf("%s: status %d, want 500", env, rec.Code)
+			}
+			if strings.Contains(body, "does not exist") != showsDetail {
+				t.Errorf("%s, htmx %v: detail shown is %v, want %v:\n%s", env, htmx, !showsDetail, showsDetail, body)
+			}
+			if strings.Contains(body, "<html") == htmx {
+				t.Errorf("%s, htmx %v: wrong variant:\n%s", env, htmx, body)
+			}
+		}
+	}
+}
+
+func TestViewNamesCantTraverse(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	get := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Hx-Request", "true")
+		rec := httptest.NewRecorder()
+		s.routes().ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, path := range []string{
+		"/view/..%2Ftempl%2Findex",
+		"/view/..%5Ctempl%5Cindex",
+		"/view/home.gohtml",
+		"/view/.home",
+		"/view/home%00",
+	} {
+		rec := get(path)
+		if rec.Code != http.StatusBadRequest || strings.Contains(rec.Body.String(), "<html") {
+			t.Errorf("%s: status %d:\n%s", path, rec.Code, rec.Body)
+		}
+	}
+
+	rec := get("/view/home")
+	if rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "cannot be found") {
+		t.Errorf("home view: status %d:\n%s", rec.Code, rec.Body)
+	}
+}
@@ -1,41 +1,422 @@
 package main
 
 import (
-	"math/rand"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"math/big"
+	"strconv"
+	"strings"
 	"time"
+	"unicode/utf8"
 )
 
+var (
+	ErrFractionalAmount = errors.New("amount must be a whole number of cents")
+	ErrAmountOutOfRange = errors.New("amount is out of range")
+)
+
+// Amount is money in integer minor units (cents). It decodes from a json
+// number or a numeric string, and refuses fractions instead of truncating them.
+type Amount int64
+
+// String formats the amount as dollars, e.g. -1234 is -$12.34. Use
+// formatMoney for an account's own currency.
+func (a Amount) String() string {
+	return formatMoney(a, "USD")
+}
+
+func (a *Amount) UnmarshalJSON(b []byte) error {
+	raw := string(b)
+	if len(b) > 0 && b[0] == '"' {
+		if err := json.Unmarshal(b, &raw); err != nil {
+			return err
+		}
+	}
+
+	n, err := strconv.ParseInt(raw, 10, 64)
+	if errors.Is(err, strconv.ErrRange) {
+		return fmt.Errorf("%w: %s", ErrAmountOutOfRange, b)
+	}
+	if err != nil {
+		f, floatErr := strconv.ParseFloat(raw, 64)
+		// 1e30 is whole, just far too big
+		if errors.Is(floatErr, strconv.ErrRange) || (floatErr == nil && math.Abs(f) >= math.MaxInt64) {
+			return fmt.Errorf("%w: %s", ErrAmountOutOfRange, b)
+		}
+		if floatErr == nil {
+			return ErrFractionalAmount
+		}
+		return fmt.Errorf("invalid amount: %s", b)
+	}
+	*a = Amount(n)
+	return nil
+}
+
 type CreateAccountRequest struct {
 	FirstName string `json:"firstName"`
 	LastName  string `json:"lastName"`
+	// InitialDeposit, if given, is deposited as the account is opened
+	InitialDeposit Amount `json:"initialDeposit"`
+	// Currency is an ISO 4217 code, DEFAULT_CURRENCY if left out
+	Currency string `json:"currency"`
+	// Email is where notifications go, verification links included
+	Email string `json:"email"`
+	// ExternalId is an importer's own key for the account. Creating an
+	// account with one that's been used already returns that account
+	// instead, so imports can be re-run. Admins only.
+	ExternalId string `json:"externalId"`
+}
+
+// CreateAccountResponse is the new account, plus a token for it so the
+// client can start using it straight away
+type CreateAccountResponse struct {
+	*Account
+	Token string `json:"token"`
+}
+
+// MarshalJSON is needed since the embedded Account's own would otherwise be
+// promoted and leave the token out
+func (r CreateAccountResponse) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		accountJson
+		Token string `json:"token"`
+	}{newAccountJson(r.Account), r.Token})
+}
+
+// UpdateAccountRequest changes an account's name. PUT must give both
+// fields; PATCH leaves out the ones that stay the same.
+type UpdateAccountRequest struct {
+	FirstName *string `json:"firstName"`
+	LastName  *string `json:"lastName"`
+	// Email replaces the account's address, which then has to be verified
+	// again. An empty one removes it.
+	Email *string `json:"email"`
+	// Version, if given, is the account version the change was based on.
+	// The update is refused if the account has moved on since.
+	Version *int64 `json:"version"`
 }
 
 type TransferRequest struct {
-	ToAccount int `json:"toAccount"`
-	Amount    int `json:"amount"`
+	FromAccount int    `json:"fromAccount"`
+	ToAccount   int    `json:"toAccount"`
+	Amount      Amount `json:"amount"`
+	// Version, if given, is the version the sending account has to be at
+	Version *int64 `json:"version"`
+}
+
+// BalanceChangeRequest is the body of a deposit or withdrawal
+type BalanceChangeRequest struct {
+	Amount Amount `json:"amount"`
+	// Version, if given, is the version the account has to be at
+	Version *int64 `json:"version"`
+}
+
+type TransferResponse struct {
+	// Balance is the source account's balance after the transfer
+	Balance Amount `json:"balance"`
+	Fee     Amount `json:"fee"`
+}
+
+// FeeCharge is the fee on one transfer and the account it's credited to
+// (zero for none)
+type FeeCharge struct {
+	Amount  int64
+	Account int
+}
+
+type InterestRequest struct {
+	Rate float64 `json:"rate"`
 }
 
 type Account struct {
-	Id        int       `json:"id"`
-	FirstName string    `json:"firstName"`
-	LastName  string    `json:"lastName"`
-	Number    int64     `json:"number"`
-	Balance   int64     `json:"balance"`
+	Id        int    `json:"id"`
+	FirstName string `json:"firstName"`
+	LastName  string `json:"lastName"`
+	Number    int64  `json:"number"`
+	Balance   Amount `json:"balance"`
+	// Currency is the ISO 4217 code Balance is in, in its minor units
+	Currency  string    `json:"currency"`
 	CreatedAt time.Time `json:"createdAt"`
+	UpdatedAt time.Time `json:"updatedAt"`
+
+	LowBalanceThreshold *int64 `json:"lowBalanceThreshold"`
+	// Email is where notifications go, if the owner gave one
+	Email *string `json:"email,omitempty"`
+	// EmailVerified is set by following a verification link. With
+	// REQUIRE_EMAIL_VERIFICATION on, unverified accounts can't send transfers.
+	EmailVerified bool `json:"emailVerified"`
+	// DeletedAt is set once the account is soft deleted. Only the modified
+	// accounts feed shows deleted accounts, so pollers hear about deletes.
+	DeletedAt *time.Time `json:"deletedAt,omitempty"`
+	// ExternalId is the key an import created the account under, if any
+	ExternalId *string `json:"externalId,omitempty"`
+	// Sandbox accounts are for testing against. Reports and reconciliation
+	// leave them out unless asked to include them.
+	Sandbox bool `json:"sandbox" db:"is_sandbox"`
+	// Version goes up with every write that bumps UpdatedAt. Clients send it
+	// back with a change so it fails rather than overwrite one they missed.
+	Version int64 `json:"version"`
+	// TokenEpoch goes up each time the account's tokens are revoked
+	TokenEpoch int64 `json:"-"`
+}
+
+// MarshalJSON writes the account's times in apiTimeFormat, whatever zone
+// and precision the database handed them back with
+func (a Account) MarshalJSON() ([]byte, error) {
+	return json.Marshal(newAccountJson(&a))
+}
+
+// plainAccount is an Account without its MarshalJSON
+type plainAccount Account
+
+// accountJson is an Account as the api writes it. Its times hide the
+// account's own.
+type accountJson struct {
+	plainAccount
+	CreatedAt string  `json:"createdAt"`
+	UpdatedAt string  `json:"updatedAt"`
+	DeletedAt *string `json:"deletedAt,omitempty"`
+}
+
+func newAccountJson(a *Account) accountJson {
+	out := accountJson{
+		plainAccount: plainAccount(*a),
+		CreatedAt:    a.CreatedAt.UTC().Format(apiTimeFormat),
+		UpdatedAt:    a.UpdatedAt.UTC().Format(apiTimeFormat),
+	}
+	if a.DeletedAt != nil {
+		deletedAt := a.DeletedAt.UTC().Format(apiTimeFormat)
+		out.DeletedAt = &deletedAt
+	}
+	return out
+}
+
+// apiTimeFormat is how accounts' times are written: RFC 3339 in UTC to the
+// second, e.g. 2024-03-01T09:30:00Z
+const apiTimeFormat = time.RFC3339
+
+// AccountPage is one page of the account list. Accounts holds either whole
+// accounts or, when ?fields= was given, just those fields of each.
+type AccountPage struct {
+	Accounts any   `json:"accounts"`
+	Total    int64 `json:"total"`
+	Limit    int   `json:"limit"`
+	Offset   int   `json:"offset"`
+}
+
+type LowBalanceThresholdRequest struct {
+	Threshold *int64 `json:"threshold"`
+}
+
+type LowBalanceAlert struct {
+	AccountId int
+	Number    int64
+	Balance   int64
+	Threshold int64
+	Email     *string
 }
 
+// LogValue is what gets logged for an account. The names are hashed out by
+// the log handler unless LOG_REDACT says otherwise.
+func (a *Account) LogValue() slog.Value {
+	return slog.GroupValue(
+		slog.Int("id", a.Id),
+		slog.Int64("number", a.Number),
+		slog.String("first_name", a.FirstName),
+		slog.String("last_name", a.LastName),
+	)
+}
+
+// normalizeName trims a name and collapses the whitespace inside it to
+// single spaces, leaving the case alone: "  John   Paul " is "John Paul".
+func normalizeName(name string) string {
+	return strings.Join(strings.Fields(name), " ")
+}
+
+// nameLengthCap is the longest name the database takes whatever the policy
+// says, see alterAccountTable
+const nameLengthCap = 255
+
+// NameLengthPolicy bounds how long account names can be, in characters
+// rather than bytes so accented names aren't cut short.
+type NameLengthPolicy struct {
+	Min int
+	Max int
+}
+
+// Check says what's wrong with name, or "" if nothing is
+func (p NameLengthPolicy) Check(name string) string {
+	switch n := utf8.RuneCountInString(name); {
+	case n < p.Min:
+		return fmt.Sprintf("must be at least %d characters", p.Min)
+	case n > p.Max:
+		return fmt.Sprintf("must be at most %d characters", p.Max)
+	}
+	return ""
+}
+
+func (p NameLengthPolicy) validate() error {
+	if p.Min < 1 {
+		return fmt.Errorf("NAME_MIN_LENGTH must be at least 1")
+	}
+	if p.Max < p.Min || p.Max > nameLengthCap {
+		return fmt.Errorf("NAME_MAX_LENGTH must be between NAME_MIN_LENGTH and %d", nameLengthCap)
+	}
+	return nil
+}
+
+// nameKey is the form of a name used to match accounts up: normalized and
+// lower case, so "John " and "john" are the same person.
+func nameKey(firstName, lastName string) string {
+	return strings.ToLower(normalizeName(firstName) + " " + normalizeName(lastName))
+}
+
+// Account numbers are random 12 digit numbers, so they can't be guessed or
+// counted through. That's about 40 bits, while staying small enough for
+// javascript clients to hold exactly.
+const (
+	accountNumberMin = 100_000_000_000
+	accountNumberMax = 999_999_999_999
+)
+
 func NewAccount(firstName, lastName string) *Account {
 	return &Account{
 		FirstName: firstName,
 		LastName:  lastName,
-		Number:    rand.Int63n(10_000_000),
+		Number:    newAccountNumber(),
 		CreatedAt: time.Now().UTC(),
 	}
 }
 
+// newAccountNumber picks an account number at random. It isn't checked for
+// uniqueness here, the unique index on account.number does that.
+func newAccountNumber() int64 {
+	n, err := rand.Int(rand.Reader, big.NewInt(accountNumberMax-accountNumberMin+1))
+	if err != nil {
+		// crypto/rand doesn't fail on any platform we run on
+		panic(err)
+	}
+	return accountNumberMin + n.Int64()
+}
+
+// TransferWhitelist is where an account may send money. While Enabled,
+// transfers to any account whose number isn't in Numbers are refused.
+type TransferWhitelist struct {
+	Enabled bool    `json:"enabled"`
+	Numbers []int64 `json:"numbers"`
+}
+
+// WhitelistEnabledRequest switches a whitelist on or off
+type WhitelistEnabledRequest struct {
+	Enabled *bool `json:"enabled"`
+}
+
+// WhitelistEntryRequest adds an account number to a whitelist
+type WhitelistEntryRequest struct {
+	Number int64 `json:"number"`
+}
+
+// TransferRecord is a completed transfer. The account ids and numbers are nil
+// when that account has since been deleted.
+type TransferRecord struct {
+	Id          int       `json:"id"`
+	FromAccount *int      `json:"fromAccount"`
+	FromNumber  *int64    `json:"fromNumber"`
+	ToAccount   *int      `json:"toAccount"`
+	ToNumber    *int64    `json:"toNumber"`
+	Amount      Amount    `json:"amount"`
+	CreatedAt   time.Time `json:"createdAt"`
+}
+
+// DuplicateAccountGroup is a set of accounts that look like the same person,
+// Key being the normalized name they share
+type DuplicateAccountGroup struct {
+	Key      string     `json:"key"`
+	Accounts []*Account `json:"accounts"`
+}
+
+// Reconciliation compares what the accounts hold with what the ledger says
+// they should. Any difference means money moved without a ledger entry.
+type Reconciliation struct {
+	TotalBalance Amount `json:"totalBalance"`
+	LedgerTotal  Amount `json:"ledgerTotal"`
+	Discrepancy  Amount `json:"discrepancy"`
+	Balanced     bool   `json:"balanced"`
+	// MismatchedAccounts are the ids of accounts whose own balance and ledger
+	// disagree, at most maxReconcileMismatches of them
+	MismatchedAccounts []int `json:"mismatchedAccounts"`
+}
+
+// LedgerEntry is one change to an account's balance
+type LedgerEntry struct {
+	Id        int       `json:"id"`
+	AccountId int       `json:"accountId"`
+	Amount    Amount    `json:"amount"`
+	Kind      string    `json:"kind"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// BalanceSnapshot is what an account's balance was when a snapshot was taken
+type BalanceSnapshot struct {
+	AccountId int       `json:"accountId"`
+	TakenAt   time.Time `json:"takenAt"`
+	Balance   Amount    `json:"balance"`
+	Currency  string    `json:"currency"`
+}
+
+// SnapshotRun is one TakeBalanceSnapshot: when, and how many accounts
+type SnapshotRun struct {
+	TakenAt  time.Time `json:"takenAt"`
+	Accounts int64     `json:"accounts"`
+}
+
+// Statement covers an account's ledger from From up to (not including) To
+type Statement struct {
+	AccountId      int
+	From           time.Time
+	To             time.Time
+	OpeningBalance Amount
+	ClosingBalance Amount
+	Entries        []*LedgerEntry
+}
+
+type DailyTransferCount struct {
+	Day    time.Time `json:"day"`
+	Count  int64     `json:"count"`
+	Amount Amount    `json:"amount"`
+}
+
 type DiscordUser struct {
 	Id         string `json:"id"`
 	GlobalName string `json:"global_name"`
 	Avatar     string `json:"avatar"`
 	LastSignIn time.Time
+	// SignedOutAt is when the user last logged out, if ever
+	SignedOutAt *time.Time `json:"-"`
+	// DeactivatedAt is when the user was cleaned up for not signing in. It's
+	// cleared again if they come back.
+	DeactivatedAt *time.Time `json:"-"`
+}
+
+// AvatarURL is where the discord cdn serves the user's avatar, or their
+// default embed avatar if they haven't set one. Unlike avatarFetcher.Resolve
+// it doesn't check the image is really there.
+func (u *DiscordUser) AvatarURL() string {
+	if u.Avatar == "" {
+		return defaultAvatarURL(discordCdnUrl, u.Id)
+	}
+	return fmt.Sprintf("%s/avatars/%s/%s.png", discordCdnUrl, u.Id, u.Avatar)
+}
+
+// DiscordUserSummary is what admins get to see of a user. The avatar hash
+// isn't included, nothing needs it outside of building the avatar url.
+type DiscordUserSummary struct {
+	Id            string     `json:"id"`
+	GlobalName    string     `json:"globalName"`
+	LastSignIn    time.Time  `json:"lastSignIn"`
+	DeactivatedAt *time.Time `json:"deactivatedAt,omitempty"`
 }
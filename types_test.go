@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestAmountUnmarshal(t *testing.T) {
+	for in, want := range map[string]Amount{
+		`150`:   150,
+		`"150"`: 150,
+		`-20`:   -20,
+		`"0"`:   0,
+	} {
+		var got Amount
+		if err := json.Unmarshal([]byte(in), &got); err != nil {
+			t.Errorf("%s: %v", in, err)
+		} else if got != want {
+			t.Errorf("%s decoded to %d, want %d", in, got, want)
+		}
+	}
+
+	for _, in := range []string{`1.5`, `"1.5"`, `0.01`} {
+		var got Amount
+		if err := json.Unmarshal([]byte(in), &got); !errors.Is(err, ErrFractionalAmount) {
+			t.Errorf("%s: err = %v, want ErrFractionalAmount", in, err)
+		}
+	}
+}
+
+func TestAmountRoundTrip(t *testing.T) {
+	for _, want := range []Amount{0, 1, -1, 1234, math.MaxInt64, math.MinInt64} {
+		b, err := json.Marshal(want)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got Amount
+		if err := json.Unmarshal(b, &got); err != nil || got != want {
+			t.Errorf("%d came back as %d, %v", want, got, err)
+		}
+	}
+}
+
+func TestAmountUnmarshalMalformed(t *testing.T) {
+	for in, want := range map[string]error{
+		`9223372036854775808`:    ErrAmountOutOfRange,
+		`"-9223372036854775809"`: ErrAmountOutOfRange,
+		`1e30`:                   ErrAmountOutOfRange,
+		`1e400`:                  ErrAmountOutOfRange,
+	} {
+		var got Amount
+		if err := json.Unmarshal([]byte(in), &got); !errors.Is(err, want) {
+			t.Errorf("%s: err = %v, want %v", in, err, want)
+		}
+	}
+	for _, in := range []string{`"abc"`, `""`, `"12 dollars"`, `true`, `[1]`, `{"amount":1}`} {
+		var got Amount
+		if err := json.Unmarshal([]byte(in), &got); err == nil {
+			t.Errorf("%s decoded to %d", in, got)
+		}
+	}
+}
+
+func TestNewAccountNumber(t *testing.T) {
+	seen := map[int64]bool{}
+	for i := 0; i < 1000; i++ {
+		n := newAccountNumber()
+		if n < accountNumberMin || n > accountNumberMax {
+			t.Fatalf("%d is out of range", n)
+		}
+		seen[n] = true
+	}
+	// a repeat in a thousand draws from nine hundred billion would be news
+	if len(seen) != 1000 {
+		t.Errorf("%d distinct numbers in 1000 draws", len(seen))
+	}
+}
+
+func TestNormalizeName(t *testing.T) {
+	for in, want := range map[string]string{
+		"  John   Paul ": "John Paul",
+		"Ada":            "Ada",
+		"\tMary\nAnn":    "Mary Ann",
+		"McDONALD":       "McDONALD",
+		"   ":            "",
+	} {
+		if got := normalizeName(in); got != want {
+			t.Errorf("normalizeName(%q) = %q, want %q", in, got, want)
+		}
+	}
+	if nameKey(" ada ", "LOVELACE") != nameKey("Ada", "Lovelace") {
+		t.Error("name keys differ by case and spacing")
+	}
+}
+
+func TestDiscordUserAvatarURL(t *testing.T) {
+	for _, test := range []struct {
+		user DiscordUser
+		want string
+	}{
+		{DiscordUser{Id: "80351110224678912", Avatar: "8342729096ea3675442027381ff50dfe"},
+			"https://cdn.discordapp.com/avatars/80351110224678912/8342729096ea3675442027381ff50dfe.png"},
+		// (80351110224678912 >> 22) % 6
+		{DiscordUser{Id: "80351110224678912"}, "https://cdn.discordapp.com/embed/avatars/5.png"},
+		{DiscordUser{Id: "0"}, "https://cdn.discordapp.com/embed/avatars/0.png"},
+	} {
+		if got := test.user.AvatarURL(); got != test.want {
+			t.Errorf("avatar of %+v is %s, want %s", test.user, got, test.want)
+		}
+	}
+}
+
+func TestNameLengthPolicy(t *testing.T) {
+	policy := NameLengthPolicy{Min: 2, Max: 5}
+	for name, ok := range map[string]bool{
+		"A":      false,
+		"Al":     true,
+		"Alice":  true,
+		"Alicia": false,
+		// five characters, but more bytes than that
+		"Zoë Ö": true,
+	} {
+		if problem := policy.Check(name); (problem == "") != ok {
+			t.Errorf("Check(%q) = %q, want ok %v", name, problem, ok)
+		}
+	}
+
+	for _, bad := range []NameLengthPolicy{{0, 10}, {5, 4}, {1, nameLengthCap + 1}} {
+		if bad.validate() == nil {
+			t.Errorf("%+v passed validation", bad)
+		}
+	}
+}
+
+func TestAccountTimesAreRFC3339UTC(t *testing.T) {
+	india := time.FixedZone("IST", 5*60*60+30*60)
+	deleted := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)
+	account := &Account{
+		Id:        1,
+		CreatedAt: time.Date(2024, 3, 1, 15, 0, 0, 123456789, india),
+		UpdatedAt: time.Date(2024, 3, 1, 9, 45, 1, 0, time.UTC),
+		DeletedAt: &deleted,
+	}
+
+	for name, v := range map[string]any{
+		"account":         account,
+		"create response": &CreateAccountResponse{Account: account, Token: "token"},
+	} {
+		b, err := json.Marshal(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got map[string]any
+		if err := json.Unmarshal(b, &got); err != nil {
+			t.Fatal(err)
+		}
+		for key, want := range map[string]string{
+			"createdAt": "2024-03-01T09:30:00Z",
+			"updatedAt": "2024-03-01T09:45:01Z",
+			"deletedAt": "2024-03-02T00:00:00Z",
+		} {
+			if got[key] != want {
+				t.Errorf("%s: %s is %v, want %s", name, key, got[key], want)
+			}
+		}
+		if name == "create response" && got["token"] != "token" {
+			t.Errorf("create response lost its token: %s", b)
+		}
+	}
+}
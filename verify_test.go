@@ -0,0 +1,65 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUnverifiedAccountsCantTransfer(t *testing.T) {
+	s := newTestServer(t, NewMockStore())
+	s.config.RequireEmailVerification = true
+	notifier := &recordingNotifier{}
+	s.notifier = notifier
+
+	email := "ada@example.com"
+	from := NewAccount("Ada", "Lovelace")
+	from.Currency, from.Email = "USD", &email
+	from, err := s.store.CreateAccount(context.Background(), from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	token, err := s.createJwt(from)
+	if err != nil {
+		t.Fatal(err)
+	}
+	to, _ := newTestAccount(t, s, "Charles", "Babbage")
+	if _, err := s.store.Deposit(context.Background(), from.Id, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	wantApiError(t, transfer(s, token, from.Id, to.Id, 100), http.StatusForbidden, CodeEmailUnverified)
+
+	rec := serve(s, httptest.NewRequest(http.MethodPost, fmt.Sprintf("/account/%d/verification", from.Id), nil), token)
+	if rec.Code != http.StatusAccepted || len(notifier.events) != 1 {
+		t.Fatalf("status %d, %d events: %s", rec.Code, len(notifier.events), rec.Body)
+	}
+	link := notifier.events[0].Link
+	if notifier.events[0].Kind != EventVerifyEmail || notifier.events[0].Email != email {
+		t.Errorf("sent %+v", notifier.events[0])
+	}
+
+	// a link for someone else's account, made by changing the id
+	forged := strings.Replace(link, fmt.Sprintf("token=%d.", from.Id), fmt.Sprintf("token=%d.", to.Id), 1)
+	wantApiError(t, serve(s, httptest.NewRequest(http.MethodGet, forged, nil), ""), http.StatusBadRequest, CodeInvalidRequest)
+
+	if rec := serve(s, httptest.NewRequest(http.MethodGet, link, nil), ""); rec.Code != http.StatusOK {
+		t.Fatalf("following the link: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := transfer(s, token, from.Id, to.Id, 100); rec.Code != http.StatusOK {
+		t.Errorf("verified transfer: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// with verification off nobody is held up
+	s.config.RequireEmailVerification = false
+	other, otherToken := newTestAccount(t, s, "Grace", "Hopper")
+	if _, err := s.store.Deposit(context.Background(), other.Id, 1000, nil); err != nil {
+		t.Fatal(err)
+	}
+	if rec := transfer(s, otherToken, other.Id, to.Id, 100); rec.Code != http.StatusOK {
+		t.Errorf("verification off: status %d: %s", rec.Code, rec.Body)
+	}
+}
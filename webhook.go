@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const EventTransferCompleted = "transfer.completed"
+
+// webhookQueueSize is how many deliveries can wait for the sender before new
+// ones are dead lettered instead of holding up the request
+const webhookQueueSize = 256
+
+// TransferWebhook is the data of a transfer.completed webhook
+type TransferWebhook struct {
+	FromAccount int   `json:"fromAccount"`
+	ToAccount   int   `json:"toAccount"`
+	Amount      int64 `json:"amount"`
+	Fee         int64 `json:"fee"`
+}
+
+// webhookSender posts events to the configured urls in the background, so a
+// slow or broken receiver never holds up (or undoes) what the event is about.
+// Each body is signed with the webhook secret: receivers recompute
+// hex(hmac-sha256(secret, timestamp + "." + body)) and compare it to the
+// X-Webhook-Signature header. The timestamp is there to stop replays.
+// Deliveries that still fail after maxRetries are logged as dead letters,
+// payload included, so they can be replayed by hand.
+type webhookSender struct {
+	urls       []string
+	secret     string
+	client     *http.Client
+	maxRetries int
+	backoff    time.Duration
+	logger     *slog.Logger
+
+	queue chan []byte
+	stop  chan struct{}
+	done  chan struct{}
+}
+
+func newWebhookSender(urls []string, secret string, logger *slog.Logger) *webhookSender {
+	return &webhookSender{
+		urls:       urls,
+		secret:     secret,
+		client:     &http.Client{Timeout: 5 * time.Second},
+		maxRetries: 3,
+		backoff:    time.Second,
+		logger:     logger,
+		queue:      make(chan []byte, webhookQueueSize),
+		stop:       make(chan struct{}),
+		done:       make(chan struct{}),
+	}
+}
+
+// Send queues kind with data for delivery to every url. It never blocks.
+func (w *webhookSender) Send(ctx context.Context, kind string, data any) {
+	if len(w.urls) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]any{"kind": kind, "data": data, "sentAt": time.Now().UTC()})
+	if err != nil {
+		w.logger.ErrorContext(ctx, "encoding webhook", "kind", kind, "err", err)
+		return
+	}
+
+	select {
+	case w.queue <- body:
+	default:
+		w.logger.ErrorContext(ctx, "webhook dead letter", "reason", "queue full", "payload", string(body))
+	}
+}
+
+// run delivers queued webhooks until Close is called
+func (w *webhookSender) run() {
+	defer close(w.done)
+	for {
+		select {
+		case body := <-w.queue:
+			w.deliverAll(body)
+		case <-w.stop:
+			// finish what's already been queued
+			for {
+				select {
+				case body := <-w.queue:
+					w.deliverAll(body)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// Close stops the sender once the queue is empty, or when ctx is done
+func (w *webhookSender) Close(ctx context.Context) {
+	close(w.stop)
+	select {
+	case <-w.done:
+	case <-ctx.Done():
+		w.logger.Warn("webhooks still pending at shutdown", "queued", len(w.queue))
+	}
+}
+
+func (w *webhookSender) deliverAll(body []byte) {
+	for _, url := range w.urls {
+		if err := w.deliver(url, body); err != nil {
+			w.logger.Error("webhook dead letter", "url", url, "err", err, "payload", string(body))
+		}
+	}
+}
+
+// deliver posts body to url, retrying up to maxRetries times with a growing
+// backoff. Anything but a 2xx counts as a failure.
+func (w *webhookSender) deliver(url string, body []byte) error {
+	var err error
+	for attempt := 0; attempt <= w.maxRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(w.backoff * time.Duration(attempt))
+		}
+		if err = w.post(url, body); err == nil {
+			return nil
+		}
+		w.logger.Warn("webhook delivery failed", "url", url, "attempt", attempt+1, "err", err)
+	}
+	return err
+}
+
+func (w *webhookSender) post(url string, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Webhook-Timestamp", timestamp)
+	req.Header.Set("X-Webhook-Signature", signWebhook(w.secret, timestamp, body))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("receiver returned %s", res.Status)
+	}
+	return nil
+}
+
+func signWebhook(secret, timestamp string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(timestamp + "."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// webhookReceiver records what it's sent, after turning away the first
+// failures posts
+type webhookReceiver struct {
+	mu       sync.Mutex
+	failures int
+	attempts int
+	received []*http.Request
+	bodies   [][]byte
+}
+
+func (rcv *webhookReceiver) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	rcv.mu.Lock()
+	defer rcv.mu.Unlock()
+	rcv.attempts++
+	if rcv.attempts <= rcv.failures {
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	rcv.received = append(rcv.received, r)
+	rcv.bodies = append(rcv.bodies, body)
+}
+
+func newTestWebhookSender(t *testing.T, rcv *webhookReceiver) *webhookSender {
+	t.Helper()
+	server := httptest.NewServer(rcv)
+	t.Cleanup(server.Close)
+	w := newWebhookSender([]string{server.URL}, "test-webhook-secret", slog.New(slog.NewTextHandler(io.Discard, nil)))
+	w.backoff = time.Millisecond
+	go w.run()
+	return w
+}
+
+func TestWebhookIsSigned(t *testing.T) {
+	rcv := &webhookReceiver{}
+	w := newTestWebhookSender(t, rcv)
+	w.Send(context.Background(), EventTransferCompleted, &TransferWebhook{FromAccount: 1, ToAccount: 2, Amount: 300})
+	w.Close(context.Background())
+
+	if len(rcv.received) != 1 {
+		t.Fatalf("received %d webhooks, want 1", len(rcv.received))
+	}
+	req, body := rcv.received[0], rcv.bodies[0]
+	// what a receiver would do to check it
+	mac := hmac.New(sha256.New, []byte("test-webhook-secret"))
+	mac.Write([]byte(req.Header.Get("X-Webhook-Timestamp") + "."))
+	mac.Write(body)
+	if got := req.Header.Get("X-Webhook-Signature"); got != hex.EncodeToString(mac.Sum(nil)) {
+		t.Errorf("signature %q doesn't match the body", got)
+	}
+
+	var payload struct {
+		Kind string          `json:"kind"`
+		Data TransferWebhook `json:"data"`
+	}
+	if err := json.Unmarshal(body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Kind != EventTransferCompleted || payload.Data.Amount != 300 {
+		t.Errorf("got %+v", payload)
+	}
+}
+
+func TestWebhookRetries(t *testing.T) {
+	rcv := &webhookReceiver{failures: 2}
+	w := newTestWebhookSender(t, rcv)
+	w.Send(context.Background(), EventTransferCompleted, &TransferWebhook{})
+	w.Close(context.Background())
+	if rcv.attempts != 3 || len(rcv.received) != 1 {
+		t.Errorf("%d attempts, %d delivered, want 3 and 1", rcv.attempts, len(rcv.received))
+	}
+
+	// one more failure than there are retries
+	rcv = &webhookReceiver{failures: 4}
+	w = newTestWebhookSender(t, rcv)
+	w.Send(context.Background(), EventTransferCompleted, &TransferWebhook{})
+	w.Close(context.Background())
+	if rcv.attempts != 4 || len(rcv.received) != 0 {
+		t.Errorf("%d attempts, %d delivered, want 4 and none", rcv.attempts, len(rcv.received))
+	}
+}